@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+)
+
+func handlerPutUserRoles(w http.ResponseWriter, r *http.Request, db database.Store) {
+	userIDStr := r.PathValue("userID")
+	userID, err := strconv.Atoi(userIDStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Roles []string `json:"roles"`
+	}{}
+	err = decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.SetUserRoles(userID, request.Roles)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to update roles")
+		return
+	}
+
+	userRespond := struct {
+		ID          int       `json:"id"`
+		Email       string    `json:"email"`
+		Handle      string    `json:"handle"`
+		IsChirpyRed bool      `json:"is_chirpy_red"`
+		Verified    bool      `json:"verified"`
+		Roles       []string  `json:"roles"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
+	}{
+		ID:          user.ID,
+		Email:       user.Email,
+		Handle:      user.Handle,
+		IsChirpyRed: user.IsChirpyRed,
+		Verified:    user.Verified,
+		Roles:       user.Roles,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+
+	respondWithJSON(w, userRespond, http.StatusOK)
+}
@@ -0,0 +1,59 @@
+// Package atomicfile replaces files so that readers and crashes only ever see
+// the old or the new contents.
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces path with data, which is written to a temporary file in
+// the same directory, synced, and renamed over path. The directory is synced
+// too, so the rename survives a crash.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Not every platform supports fsync on directories; the rename itself
+	// has already happened, so only report real I/O failures.
+	err = file.Sync()
+	if err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// DB keeps the decoded file in memory so reads do not touch the disk. Writes
+// go through to the file, and a background check drops the cache when the
+// file is changed by anything other than this DB.
+
+const cacheCheckInterval = 2 * time.Second
+
+type dbIndex struct {
+	userIDByEmail           map[string]int
+	userIDByHandle          map[string]int
+	refreshTokenIDByHash    map[string]int
+	refreshTokenIDsByFamily map[int][]int
+	familyIDsByUser         map[int][]int
+	// chirpIDs holds, per sort order, the chirp IDs of each author sorted
+	// ascending by that order; author 0 holds every chirp.
+	chirpIDs           map[string]map[int][]int
+	revisionIDsByChirp map[int][]int
+	reportIDsByChirp   map[int][]int
+
+	passwordResetTokenIDByHash map[string]int
+}
+
+type fileState struct {
+	snapshotModTime int64
+	snapshotSize    int64
+	walModTime      int64
+	walSize         int64
+}
+
+func buildIndex(dbStructure *DBStructure) dbIndex {
+	index := dbIndex{
+		userIDByEmail:           map[string]int{},
+		userIDByHandle:          map[string]int{},
+		refreshTokenIDByHash:    map[string]int{},
+		refreshTokenIDsByFamily: map[int][]int{},
+		familyIDsByUser:         map[int][]int{},
+		chirpIDs: map[string]map[int][]int{
+			OrderByID:        {},
+			OrderByCreatedAt: {},
+		},
+		revisionIDsByChirp: map[int][]int{},
+		reportIDsByChirp:   map[int][]int{},
+
+		passwordResetTokenIDByHash: map[string]int{},
+	}
+
+	userIDs := []int{}
+	for userID := range dbStructure.Users {
+		userIDs = append(userIDs, userID)
+	}
+	// Insert in ID order so that, for duplicates created before emails were
+	// unique, the oldest account keeps the email.
+	sort.Ints(userIDs)
+	for _, userID := range userIDs {
+		index.addUser(dbStructure.Users[userID])
+	}
+
+	for _, refreshToken := range dbStructure.RefreshTokens {
+		index.addRefreshToken(refreshToken)
+	}
+
+	for _, chirp := range dbStructure.Chirps {
+		index.addChirp(dbStructure.Chirps, chirp)
+	}
+
+	for _, revision := range dbStructure.ChirpRevisions {
+		index.addChirpRevision(revision)
+	}
+
+	for _, report := range dbStructure.Reports {
+		index.reportIDsByChirp[report.ChirpID] = insertID(index.reportIDsByChirp[report.ChirpID], report.ID)
+	}
+
+	for _, resetToken := range dbStructure.PasswordResetTokens {
+		index.passwordResetTokenIDByHash[resetToken.TokenHash] = resetToken.ID
+	}
+
+	return index
+}
+
+func (index *dbIndex) addUser(user User) {
+	email := NormalizeEmail(user.Email)
+	if _, taken := index.userIDByEmail[email]; !taken {
+		index.userIDByEmail[email] = user.ID
+	}
+	if user.Handle != "" {
+		index.userIDByHandle[user.Handle] = user.ID
+	}
+}
+
+func (index *dbIndex) removeUser(user User) {
+	email := NormalizeEmail(user.Email)
+	if index.userIDByEmail[email] == user.ID {
+		delete(index.userIDByEmail, email)
+	}
+	if index.userIDByHandle[user.Handle] == user.ID {
+		delete(index.userIDByHandle, user.Handle)
+	}
+}
+
+// addChirp indexes chirp. chirps must hold the indexed chirps as they were
+// when they were added.
+func (index *dbIndex) addChirp(chirps map[int]Chirp, chirp Chirp) {
+	for orderBy, idsByAuthor := range index.chirpIDs {
+		less := chirpLess(orderBy)
+		for _, authorID := range []int{0, chirp.AuthorID} {
+			idsByAuthor[authorID] = insertSorted(idsByAuthor[authorID], chirps, chirp, less)
+		}
+	}
+}
+
+func (index *dbIndex) removeChirp(chirps map[int]Chirp, chirp Chirp) {
+	for orderBy, idsByAuthor := range index.chirpIDs {
+		less := chirpLess(orderBy)
+		for _, authorID := range []int{0, chirp.AuthorID} {
+			idsByAuthor[authorID] = removeSorted(idsByAuthor[authorID], chirps, chirp, less)
+		}
+		if len(idsByAuthor[chirp.AuthorID]) == 0 {
+			delete(idsByAuthor, chirp.AuthorID)
+		}
+	}
+}
+
+func insertSorted(ids []int, chirps map[int]Chirp, chirp Chirp, less func(a, b Chirp) bool) []int {
+	i := sort.Search(len(ids), func(i int) bool { return !less(chirps[ids[i]], chirp) })
+	if i < len(ids) && ids[i] == chirp.ID {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = chirp.ID
+	return ids
+}
+
+func removeSorted(ids []int, chirps map[int]Chirp, chirp Chirp, less func(a, b Chirp) bool) []int {
+	i := sort.Search(len(ids), func(i int) bool { return !less(chirps[ids[i]], chirp) })
+	if i == len(ids) || ids[i] != chirp.ID {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+func (index *dbIndex) addChirpRevision(revision ChirpRevision) {
+	index.revisionIDsByChirp[revision.ChirpID] = insertID(index.revisionIDsByChirp[revision.ChirpID], revision.ID)
+}
+
+func (index *dbIndex) removeChirpRevision(revision ChirpRevision) {
+	revisionIDs := removeID(index.revisionIDsByChirp[revision.ChirpID], revision.ID)
+	if len(revisionIDs) == 0 {
+		delete(index.revisionIDsByChirp, revision.ChirpID)
+		return
+	}
+	index.revisionIDsByChirp[revision.ChirpID] = revisionIDs
+}
+
+func (index *dbIndex) addRefreshToken(refreshToken RefreshToken) {
+	index.refreshTokenIDByHash[refreshToken.TokenHash] = refreshToken.ID
+	index.refreshTokenIDsByFamily[refreshToken.FamilyID] = insertID(index.refreshTokenIDsByFamily[refreshToken.FamilyID], refreshToken.ID)
+	index.familyIDsByUser[refreshToken.UserID] = insertID(index.familyIDsByUser[refreshToken.UserID], refreshToken.FamilyID)
+}
+
+func (index *dbIndex) removeRefreshToken(refreshToken RefreshToken) {
+	delete(index.refreshTokenIDByHash, refreshToken.TokenHash)
+	tokenIDs := removeID(index.refreshTokenIDsByFamily[refreshToken.FamilyID], refreshToken.ID)
+	if len(tokenIDs) > 0 {
+		index.refreshTokenIDsByFamily[refreshToken.FamilyID] = tokenIDs
+		return
+	}
+	delete(index.refreshTokenIDsByFamily, refreshToken.FamilyID)
+
+	familyIDs := removeID(index.familyIDsByUser[refreshToken.UserID], refreshToken.FamilyID)
+	if len(familyIDs) == 0 {
+		delete(index.familyIDsByUser, refreshToken.UserID)
+		return
+	}
+	index.familyIDsByUser[refreshToken.UserID] = familyIDs
+}
+
+// insertID and removeID keep a slice of IDs sorted.
+func insertID(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+func removeID(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// ensureLoadedLocked fills the cache from disk if it is empty. The caller
+// must hold the write lock.
+func (db *DB) ensureLoadedLocked() error {
+	if db.cache != nil {
+		return nil
+	}
+
+	dbStructure, err := db.readLocked()
+	if err != nil {
+		return err
+	}
+	state, err := db.statFiles()
+	if err != nil {
+		return err
+	}
+
+	db.cache = &dbStructure
+	db.index = buildIndex(db.cache)
+	db.fileState = state
+	return nil
+}
+
+// invalidateLocked drops the cache; the next access reloads it from disk.
+func (db *DB) invalidateLocked() {
+	db.cache = nil
+	db.index = dbIndex{}
+}
+
+func (db *DB) statFiles() (fileState, error) {
+	var state fileState
+
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return state, err
+	}
+	state.snapshotModTime = info.ModTime().UnixNano()
+	state.snapshotSize = info.Size()
+
+	info, err = os.Stat(db.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.walModTime = info.ModTime().UnixNano()
+	state.walSize = info.Size()
+
+	return state, nil
+}
+
+func (db *DB) watchFiles() {
+	ticker := time.NewTicker(cacheCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+			db.mux.Lock()
+			if db.cache != nil {
+				state, err := db.statFiles()
+				if err != nil || state != db.fileState {
+					db.invalidateLocked()
+				}
+			}
+			db.mux.Unlock()
+		}
+	}
+}
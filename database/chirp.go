@@ -1,16 +1,19 @@
 package database
 
 import (
-	"errors"
-	"fmt"
-	"strings"
+	"time"
 	"unicode/utf8"
 )
 
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorID int    `json:"author_id"`
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorID  int       `json:"author_id"`
+	Edited    bool      `json:"edited"`
+	Flagged   bool      `json:"flagged"`
+	Hidden    bool      `json:"hidden"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 func NewChirp(body string, id int, authorID int) (*Chirp, error) {
@@ -19,36 +22,50 @@ func NewChirp(body string, id int, authorID int) (*Chirp, error) {
 		return nil, err
 	}
 
+	now := time.Now().UTC()
 	newChirp := Chirp{
-		ID:       id,
-		Body:     validatedBody,
-		AuthorID: authorID,
+		ID:        id,
+		Body:      validatedBody,
+		AuthorID:  authorID,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
 	return &newChirp, nil
 }
 
-func validateChirp(chirp string) (string, error) {
-	chirpLength := utf8.RuneCountInString(chirp)
-	if chirpLength > 140 {
-		errorMessage := fmt.Sprintf("The chirp(len = %v) exeeds the rune limit of 140", chirpLength)
-		return "", errors.New(errorMessage)
+// Edit replaces the body of chirp with body, which was moderated again and
+// flagged or not, and returns the revision holding the previous body. The
+// revision ID is left for the store to assign.
+func (chirp *Chirp) Edit(body string, flagged bool) (ChirpRevision, error) {
+	validatedBody, err := validateChirp(body)
+	if err != nil {
+		return ChirpRevision{}, err
 	}
 
-	cleanedChirp := cleanChirp(chirp)
+	now := time.Now().UTC()
+	revision := ChirpRevision{
+		ChirpID:    chirp.ID,
+		Body:       chirp.Body,
+		CreatedAt:  chirp.UpdatedAt,
+		ReplacedAt: now,
+	}
 
-	return cleanedChirp, nil
+	chirp.Body = validatedBody
+	chirp.Edited = true
+	chirp.Flagged = flagged
+	chirp.UpdatedAt = now
+
+	return revision, nil
 }
 
-func cleanChirp(chirp string) string {
-	wordsToCensor := [3]string{"kerfuffle", "sharbert", "fornax"}
-	chirpWords := strings.Split(chirp, " ")
-	for chirpyIndex, chirpWord := range chirpWords {
-		for _, wordToCensor := range wordsToCensor {
-			if strings.ToLower(chirpWord) == wordToCensor {
-				chirpWords[chirpyIndex] = "****"
-			}
-		}
+// validateChirp only checks the length; the wording is moderated by the
+// caller before the body reaches the database.
+func validateChirp(chirp string) (string, error) {
+	chirpLength := utf8.RuneCountInString(chirp)
+	if chirpLength > 140 {
+		return "", validationError("body", "the chirp (len = %v) exceeds the rune limit of 140", chirpLength)
 	}
-	return strings.Join(chirpWords, " ")
+
+	return chirp, nil
 }
@@ -0,0 +1,16 @@
+package database
+
+import (
+	"time"
+)
+
+// ChirpRevision is a body a chirp had before it was edited.
+type ChirpRevision struct {
+	ID      int    `json:"id"`
+	ChirpID int    `json:"chirp_id"`
+	Body    string `json:"body"`
+	// CreatedAt is when this body was written and ReplacedAt when the edit
+	// that replaced it was made.
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
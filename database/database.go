@@ -3,36 +3,77 @@ package database
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/Romasav/chirpy/atomicfile"
 )
 
 type DBStructure struct {
+	SchemaVersion int                  `json:"schema_version"`
+	Sequences     map[string]int       `json:"sequences"`
 	Chirps        map[int]Chirp        `json:"chirps"`
 	Users         map[int]User         `json:"users"`
 	RefreshTokens map[int]RefreshToken `json:"refresh_tokens"`
+	// ChirpRevisions is keyed by revision ID.
+	ChirpRevisions map[int]ChirpRevision `json:"chirp_revisions"`
+	Reports        map[int]Report        `json:"reports"`
+
+	PasswordResetTokens map[int]PasswordResetToken `json:"password_reset_tokens"`
 }
 
-func NewDBStructure(chirps map[int]Chirp, users map[int]User, refreshTokens map[int]RefreshToken) (*DBStructure, error) {
+func NewDBStructure(chirps map[int]Chirp, users map[int]User, refreshTokens map[int]RefreshToken, chirpRevisions map[int]ChirpRevision, reports map[int]Report, passwordResetTokens map[int]PasswordResetToken) (*DBStructure, error) {
 	newDBStructure := DBStructure{
-		Chirps:        chirps,
-		Users:         users,
-		RefreshTokens: refreshTokens,
+		SchemaVersion:       LatestSchemaVersion(),
+		Sequences:           map[string]int{},
+		Chirps:              chirps,
+		Users:               users,
+		RefreshTokens:       refreshTokens,
+		ChirpRevisions:      chirpRevisions,
+		Reports:             reports,
+		PasswordResetTokens: passwordResetTokens,
 	}
 	return &newDBStructure, nil
 }
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path         string
+	mux          *sync.RWMutex
+	wal          bool
+	compactEvery int
+	walRecords   int
+	cache        *DBStructure
+	index        dbIndex
+	fileState    fileState
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+type Options struct {
+	// WAL appends each mutation to an operation log instead of rewriting the
+	// whole file; the log is folded into the file every CompactEvery records.
+	WAL          bool
+	CompactEvery int
 }
 
 func NewDB(path string) (*DB, error) {
+	return NewDBWithOptions(path, Options{})
+}
+
+func NewDBWithOptions(path string, options Options) (*DB, error) {
+	compactEvery := options.CompactEvery
+	if compactEvery <= 0 {
+		compactEvery = defaultCompactEvery
+	}
+
 	db := DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:         path,
+		mux:          &sync.RWMutex{},
+		wal:          options.WAL,
+		compactEvery: compactEvery,
+		done:         make(chan struct{}),
 	}
 
 	err := db.ensureDB()
@@ -40,260 +81,956 @@ func NewDB(path string) (*DB, error) {
 		return nil, err
 	}
 
+	go db.watchFiles()
+
 	return &db, nil
 }
 
+func (db *DB) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.done)
+	})
+	return nil
+}
+
 func (db *DB) CreateUser(email, password string) (User, error) {
-	dbStructure, err := db.loadDB()
+	// Hash the password before taking the write lock; bcrypt is slow.
+	user, err := NewUser(0, email, password)
 	if err != nil {
 		return User{}, err
 	}
 
-	newUserId := len(dbStructure.Users) + 1
+	var newUser User
+	err = db.Update(func(tx *Tx) error {
+		if _, taken := tx.UserByEmail(user.Email); taken {
+			return ErrEmailTaken
+		}
+
+		newUserID, err := tx.NextUserID()
+		if err != nil {
+			return err
+		}
 
-	newUser, err := NewUser(newUserId, email, password)
+		newUser = *user
+		newUser.ID = newUserID
+		newUser.Handle = defaultHandle(newUserID)
+		return tx.PutUser(newUser)
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	if _, exists := dbStructure.Users[newUserId]; exists {
-		return User{}, errors.New("the user with this email already exists")
-	}
-	dbStructure.Users[newUserId] = *newUser
-	err = db.writeDB(dbStructure)
+	return newUser, nil
+}
+
+func (db *DB) GetUserByID(userID int) (User, error) {
+	var foundUser User
+	err := db.View(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+
+		foundUser = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	return *newUser, nil
+	return foundUser, nil
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbStructure, err := db.loadDB()
+	var foundUser User
+	err := db.View(func(tx *Tx) error {
+		user, exists := tx.UserByEmail(email)
+		if exists {
+			foundUser = user
+			return nil
+		}
+
+		return notFoundError("the user with email = %v was not found", email)
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return foundUser, nil
+}
+
+func (db *DB) PatchUser(userID, sessionID int, patch UserPatch) (User, error) {
+	validated, err := validateUserPatch(userID, patch)
 	if err != nil {
 		return User{}, err
 	}
 
-	users := dbStructure.Users
+	var patchedUser User
+	err = db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
 
-	for _, user := range users {
-		if user.Email == email {
-			return user, nil
+		if patch.Email != nil {
+			if owner, taken := tx.UserByEmail(validated.email); taken && owner.ID != userID {
+				return ErrEmailTaken
+			}
+			user.Verified = user.Verified && NormalizeEmail(user.Email) == NormalizeEmail(validated.email)
+			user.Email = validated.email
+		}
+		if patch.Password != nil {
+			_, err := deleteUserSessions(tx, userID, sessionID)
+			if err != nil {
+				return err
+			}
+			user.Password = validated.hashedPassword
+		}
+		if patch.Handle != nil {
+			if owner, taken := tx.UserByHandle(validated.handle); taken && owner.ID != userID {
+				return ErrHandleTaken
+			}
+			user.Handle = validated.handle
+		}
+		if patch.DisplayName != nil {
+			user.DisplayName = validated.displayName
 		}
+		if patch.Bio != nil {
+			user.Bio = validated.bio
+		}
+		if patch.AvatarURL != nil {
+			user.AvatarURL = validated.avatarURL
+		}
+
+		user.UpdatedAt = time.Now().UTC()
+		patchedUser = user
+		return tx.PutUser(user)
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	errorMessage := fmt.Sprintf("the user with email = %v dosent exists", email)
-	return User{}, errors.New(errorMessage)
+	return patchedUser, nil
 }
 
-func (db *DB) UpdateUser(updatedUser User) error {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetProfileByHandle(handle string) (Profile, error) {
+	var foundProfile Profile
+	err := db.View(func(tx *Tx) error {
+		user, exists := tx.UserByHandle(handle)
+		if !exists {
+			return notFoundError("the user with handle = %v was not found", NormalizeHandle(handle))
+		}
+
+		foundProfile = user.profile(tx.VisibleChirpCount(user.ID))
+		return nil
+	})
 	if err != nil {
-		return err
+		return Profile{}, err
 	}
 
-	users := dbStructure.Users
+	return foundProfile, nil
+}
 
-	_, exists := users[updatedUser.ID]
-	if !exists {
-		errorMessage := fmt.Sprintf("the user with id = %v dosent exists", updatedUser.ID)
-		return errors.New(errorMessage)
+func (db *DB) GetProfiles(userIDs []int) (map[int]Profile, error) {
+	profiles := map[int]Profile{}
+	err := db.View(func(tx *Tx) error {
+		for _, userID := range userIDs {
+			if _, done := profiles[userID]; done {
+				continue
+			}
+			user, exists := tx.User(userID)
+			if exists {
+				profiles[userID] = user.profile(tx.VisibleChirpCount(userID))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	users[updatedUser.ID] = updatedUser
+	return profiles, nil
+}
+
+func (db *DB) VerifyEmail(userID int, email string) (User, error) {
+	var verifiedUser User
+	err := db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+		if NormalizeEmail(user.Email) != NormalizeEmail(email) {
+			return notFoundError("the user with id = %v no longer has the email %v", userID, email)
+		}
 
-	err = db.writeDB(dbStructure)
+		verifiedUser = user
+		if user.Verified {
+			return nil
+		}
+		verifiedUser.Verified = true
+		verifiedUser.UpdatedAt = time.Now().UTC()
+		return tx.PutUser(verifiedUser)
+	})
 	if err != nil {
-		return nil
+		return User{}, err
 	}
 
-	return nil
+	return verifiedUser, nil
 }
 
 func (db *DB) UpgradeToChirpyRed(userID int) (User, error) {
-	dbStructure, err := db.loadDB()
+	var upgradedUser User
+	err := db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+
+		user.IsChirpyRed = true
+		user.UpdatedAt = time.Now().UTC()
+		upgradedUser = user
+		return tx.PutUser(user)
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user, exists := dbStructure.Users[userID]
-	if !exists {
-		return User{}, errors.New("the user was nto found")
+	return upgradedUser, nil
+}
+
+func (db *DB) SetUserRoles(userID int, roles []string) (User, error) {
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		return User{}, err
+	}
+
+	var updatedUser User
+	err = db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+
+		user.Roles = roles
+		user.UpdatedAt = time.Now().UTC()
+		updatedUser = user
+		return tx.PutUser(user)
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	user.IsChirpyRed = true
-	dbStructure.Users[userID] = user
+	return updatedUser, nil
+}
+
+func (db *DB) RehashPassword(userID int, oldHash, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists || user.Password != oldHash {
+			return nil
+		}
+
+		user.Password = hashedPassword
+		return tx.PutUser(user)
+	})
+}
+
+func (db *DB) SetMFA(userID int, mfa MFA) (User, error) {
+	var updatedUser User
+	err := db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
 
-	err = db.writeDB(dbStructure)
+		user.MFA = mfa
+		user.UpdatedAt = time.Now().UTC()
+		updatedUser = user
+		return tx.PutUser(user)
+	})
 	if err != nil {
-		return User{}, nil
+		return User{}, err
 	}
 
-	return user, nil
+	return updatedUser, nil
+}
+
+func (db *DB) UseTOTPStep(userID int, step int64) error {
+	return db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+		if step <= user.MFA.LastTOTPStep {
+			return ErrTOTPCodeReused
+		}
+
+		user.MFA.LastTOTPStep = step
+		return tx.PutUser(user)
+	})
+}
+
+func (db *DB) UseRecoveryCode(userID int, code string) error {
+	return db.Update(func(tx *Tx) error {
+		user, exists := tx.User(userID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+
+		remaining, found := removeRecoveryCode(user.MFA.RecoveryCodeHashes, code)
+		if !found {
+			return notFoundError("the recovery code was not found")
+		}
 
+		user.MFA.RecoveryCodeHashes = remaining
+		return tx.PutUser(user)
+	})
 }
 
-func (db *DB) CreateChirp(body string, authorID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) CreateChirp(body string, authorID int, flagged bool) (Chirp, error) {
+	var newChirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		newID, err := tx.NextChirpID()
+		if err != nil {
+			return err
+		}
+
+		chirp, err := NewChirp(body, newID, authorID)
+		if err != nil {
+			return err
+		}
+		chirp.Flagged = flagged
+
+		newChirp = *chirp
+		return tx.PutChirp(newChirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	newID := 0
-	for chirpID := range dbStructure.Chirps {
-		if chirpID > newID {
-			newID = chirpID
+	return newChirp, nil
+}
+
+func (db *DB) ListChirps(query ChirpQuery) (ChirpPage, error) {
+	orderBy, err := query.orderBy()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	cursor, err := decodeChirpCursor(query.Cursor, orderBy)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	var page ChirpPage
+	err = db.View(func(tx *Tx) error {
+		ids := tx.index.chirpIDs[orderBy][query.AuthorID]
+
+		chirps, hasMore := pageChirps(ids, tx.data.Chirps, query, orderBy, cursor)
+		page.Chirps = chirps
+		if hasMore {
+			page.NextCursor = encodeChirpCursor(chirps[len(chirps)-1], orderBy)
 		}
+		return nil
+	})
+	if err != nil {
+		return ChirpPage{}, err
 	}
-	newID++
 
-	chirp, err := NewChirp(body, newID, authorID)
+	return page, nil
+}
+
+func (db *DB) GetChirpByID(chirpID int) (Chirp, error) {
+	var foundChirp Chirp
+	err := db.View(func(tx *Tx) error {
+		chirp, exists := tx.Chirp(chirpID)
+		if !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		foundChirp = chirp
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	dbStructure.Chirps[newID] = *chirp
-	err = db.writeDB(dbStructure)
+	return foundChirp, nil
+}
+
+func (db *DB) EditChirp(chirpID int, body string, flagged bool) (Chirp, error) {
+	var editedChirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		chirp, exists := tx.Chirp(chirpID)
+		if !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		revision, err := chirp.Edit(body, flagged)
+		if err != nil {
+			return err
+		}
+
+		revision.ID, err = tx.NextChirpRevisionID()
+		if err != nil {
+			return err
+		}
+		err = tx.PutChirpRevision(revision)
+		if err != nil {
+			return err
+		}
+
+		editedChirp = chirp
+		return tx.PutChirp(chirp)
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	return *chirp, nil
+	return editedChirp, nil
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) SetChirpFlagged(chirpID int, flagged bool) (Chirp, error) {
+	var updatedChirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		chirp, exists := tx.Chirp(chirpID)
+		if !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		chirp.Flagged = flagged
+		updatedChirp = chirp
+		return tx.PutChirp(chirp)
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return updatedChirp, nil
+}
+
+func (db *DB) GetChirpRevisions(chirpID int) ([]ChirpRevision, error) {
+	var revisions []ChirpRevision
+	err := db.View(func(tx *Tx) error {
+		if _, exists := tx.Chirp(chirpID); !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		revisions = tx.ChirpRevisions(chirpID)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	chirpsMap := dbStructure.Chirps
-	chirpsSlice := []Chirp{}
+	return revisions, nil
+}
+
+func (db *DB) DeleteChirpByID(chirpID int) error {
+	return db.Update(func(tx *Tx) error {
+		if _, exists := tx.Chirp(chirpID); !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		return deleteChirp(tx, chirpID)
+	})
+}
 
-	for _, chirp := range chirpsMap {
-		chirpsSlice = append(chirpsSlice, chirp)
+// deleteChirp deletes a chirp together with its revisions. Reports keep
+// their copy of the chirp.
+func deleteChirp(tx *Tx, chirpID int) error {
+	for _, revision := range tx.ChirpRevisions(chirpID) {
+		err := tx.DeleteChirpRevision(revision.ID)
+		if err != nil {
+			return err
+		}
 	}
 
-	return chirpsSlice, nil
+	return tx.DeleteChirp(chirpID)
 }
 
-func (db *DB) GetChirpByID(chirpID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) CreateReport(chirpID, reporterID int, reason, details string) (Report, error) {
+	var newReport Report
+	err := db.Update(func(tx *Tx) error {
+		chirp, exists := tx.Chirp(chirpID)
+		if !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		for _, report := range tx.ReportsByChirp(chirpID) {
+			if report.ReporterID == reporterID && report.Status == ReportStatusOpen {
+				return conflictError("the chirp with id = %v was already reported by this user", chirpID)
+			}
+		}
+
+		newID, err := tx.NextReportID()
+		if err != nil {
+			return err
+		}
+
+		report, err := NewReport(newID, chirp, reporterID, reason, details)
+		if err != nil {
+			return err
+		}
+
+		newReport = *report
+		return tx.PutReport(newReport)
+	})
 	if err != nil {
-		return Chirp{}, err
+		return Report{}, err
 	}
 
-	chirpsMap := dbStructure.Chirps
+	return newReport, nil
+}
+
+func (db *DB) ListReports(status string) ([]Report, error) {
+	err := validateReportStatus(status)
+	if err != nil {
+		return nil, err
+	}
 
-	chirp, exists := chirpsMap[chirpID]
-	if !exists {
-		errorMessage := fmt.Sprintf("The chirp with id = %v was not found", chirpID)
-		return Chirp{}, errors.New(errorMessage)
+	reports := []Report{}
+	err = db.View(func(tx *Tx) error {
+		for _, report := range tx.Reports() {
+			if status == "" || report.Status == status {
+				reports = append(reports, report)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return chirp, nil
+	return reports, nil
 }
 
-func (db *DB) DeleteChirpByID(chirpID int) error {
-	dbStructure, err := db.loadDB()
+func (db *DB) ResolveReport(reportID int, action string) (Report, error) {
+	err := validateReportAction(action)
 	if err != nil {
-		return err
+		return Report{}, err
 	}
 
-	delete(dbStructure.Chirps, chirpID)
+	var resolvedReport Report
+	err = db.Update(func(tx *Tx) error {
+		report, exists := tx.Report(reportID)
+		if !exists {
+			return notFoundError("the report with id = %v was not found", reportID)
+		}
+		if report.Status != ReportStatusOpen {
+			return conflictError("the report with id = %v is already resolved", reportID)
+		}
+
+		var err error
+		now := time.Now().UTC()
+		switch action {
+		case ReportActionHide, ReportActionDelete:
+			chirp, exists := tx.Chirp(report.ChirpID)
+			if !exists {
+				return notFoundError("the chirp with id = %v was not found", report.ChirpID)
+			}
+
+			if action == ReportActionDelete {
+				err = deleteChirp(tx, chirp.ID)
+				break
+			}
+			chirp.Hidden = true
+			err = tx.PutChirp(chirp)
+		case ReportActionWarn, ReportActionSuspend:
+			user, exists := tx.User(report.ChirpAuthorID)
+			if !exists {
+				return notFoundError("the user with id = %v was not found", report.ChirpAuthorID)
+			}
+
+			if action == ReportActionWarn {
+				user.Warnings++
+			} else {
+				user.Suspended = true
+			}
+			user.UpdatedAt = now
+			err = tx.PutUser(user)
+		}
+		if err != nil {
+			return err
+		}
 
-	err = db.writeDB(dbStructure)
+		for _, openReport := range tx.ReportsByChirp(report.ChirpID) {
+			if openReport.Status != ReportStatusOpen {
+				continue
+			}
+
+			openReport.Resolve(action, now)
+			if openReport.ID == reportID {
+				resolvedReport = openReport
+			}
+			err := tx.PutReport(openReport)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return Report{}, err
 	}
 
-	return nil
+	return resolvedReport, nil
 }
 
-func (db *DB) CreateRefreshToken(id int) (RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) CreateRefreshToken(userID int, userAgent, ip string) (RefreshToken, error) {
+	refreshToken, err := NewRefreshToken(userID, 0, time.Time{}, userAgent, ip)
 	if err != nil {
 		return RefreshToken{}, err
 	}
 
-	refreshToken, err := NewRefreshToken(id)
+	err = db.Update(func(tx *Tx) error {
+		newID, err := tx.NextRefreshTokenID()
+		if err != nil {
+			return err
+		}
+
+		refreshToken.ID = newID
+		refreshToken.FamilyID = newID
+		return tx.PutRefreshToken(*refreshToken)
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
 
-	dbStructure.RefreshTokens[id] = *refreshToken
+	return *refreshToken, nil
+}
+
+func (db *DB) RotateRefreshToken(refreshToken, userAgent, ip string) (RefreshToken, error) {
+	var newRefToken RefreshToken
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		storedRefToken, exists := tx.RefreshTokenByHash(hashToken(refreshToken))
+		if !exists {
+			return notFoundError("the refresh token was not found")
+		}
 
-	err = db.writeDB(dbStructure)
+		now := time.Now().UTC()
+		if storedRefToken.RotatedAt != nil {
+			// The family is revoked even though the refresh fails, so the
+			// deletion has to be committed.
+			reused = true
+			return deleteRefreshTokenFamily(tx, storedRefToken.FamilyID)
+		}
+		if !now.Before(storedRefToken.ExpiresAt) {
+			return notFoundError("the refresh token has expired")
+		}
+
+		nextRefToken, err := NewRefreshToken(storedRefToken.UserID, storedRefToken.FamilyID, storedRefToken.CreatedAt, userAgent, ip)
+		if err != nil {
+			return err
+		}
+		nextRefToken.ID, err = tx.NextRefreshTokenID()
+		if err != nil {
+			return err
+		}
+
+		storedRefToken.RotatedAt = &now
+		err = tx.PutRefreshToken(storedRefToken)
+		if err != nil {
+			return err
+		}
+
+		newRefToken = *nextRefToken
+		return tx.PutRefreshToken(newRefToken)
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
+	if reused {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
 
-	return *refreshToken, nil
+	return newRefToken, nil
 }
 
 func (db *DB) GetRefreshTokenInfo(refreshToken string) (RefreshToken, error) {
-	dbStructure, err := db.loadDB()
+	var foundRefToken RefreshToken
+	err := db.View(func(tx *Tx) error {
+		storedRefToken, exists := tx.RefreshTokenByHash(hashToken(refreshToken))
+		if exists {
+			foundRefToken = storedRefToken
+			return nil
+		}
+
+		return notFoundError("the refresh token was not found")
+	})
 	if err != nil {
 		return RefreshToken{}, err
 	}
 
-	refreshTokens := dbStructure.RefreshTokens
+	return foundRefToken, nil
+}
+
+func (db *DB) DeleteRefreshTokenFamily(familyID int) error {
+	return db.Update(func(tx *Tx) error {
+		if len(tx.RefreshTokensByFamily(familyID)) == 0 {
+			return notFoundError("the refresh token family with id = %v was not found", familyID)
+		}
 
-	for _, storedRefToken := range refreshTokens {
-		if storedRefToken.Token == refreshToken {
-			return storedRefToken, nil
+		return deleteRefreshTokenFamily(tx, familyID)
+	})
+}
+
+func (db *DB) ListSessions(userID int) ([]Session, error) {
+	sessions := []Session{}
+	err := db.View(func(tx *Tx) error {
+		now := time.Now().UTC()
+		for _, familyID := range tx.RefreshTokenFamilies(userID) {
+			if liveRefToken, exists := liveRefreshToken(tx, familyID, now); exists {
+				sessions = append(sessions, liveRefToken.session())
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	errorMessage := fmt.Sprintf("refresh token = %v was not found", refreshToken)
-	return RefreshToken{}, errors.New(errorMessage)
+
+	sortSessions(sessions)
+	return sessions, nil
 }
 
-func (db *DB) DeleteRefreshToken(refreshToken string) error {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetSession(userID, sessionID int) (Session, error) {
+	var foundSession Session
+	err := db.View(func(tx *Tx) error {
+		liveRefToken, exists := liveRefreshToken(tx, sessionID, time.Now().UTC())
+		if !exists || liveRefToken.UserID != userID {
+			return notFoundError("the session with id = %v was not found", sessionID)
+		}
+
+		foundSession = liveRefToken.session()
+		return nil
+	})
 	if err != nil {
+		return Session{}, err
+	}
+
+	return foundSession, nil
+}
+
+func (db *DB) DeleteSession(userID, sessionID int) error {
+	return db.Update(func(tx *Tx) error {
+		refreshTokens := tx.RefreshTokensByFamily(sessionID)
+		if len(refreshTokens) == 0 || refreshTokens[0].UserID != userID {
+			return notFoundError("the session with id = %v was not found", sessionID)
+		}
+
+		return deleteRefreshTokenFamily(tx, sessionID)
+	})
+}
+
+func (db *DB) DeleteUserSessions(userID int) (int, error) {
+	revoked := 0
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		revoked, err = deleteUserSessions(tx, userID, 0)
 		return err
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	refreshTokens := dbStructure.RefreshTokens
+	return revoked, nil
+}
 
-	keyToDelete := -1
-	for key, storedRefToken := range refreshTokens {
-		if storedRefToken.Token == refreshToken {
-			keyToDelete = key
+// deleteUserSessions revokes every session of a user except keepSessionID,
+// which is 0 to keep none.
+func deleteUserSessions(tx *Tx, userID, keepSessionID int) (int, error) {
+	revoked := 0
+	for _, familyID := range tx.RefreshTokenFamilies(userID) {
+		if familyID == keepSessionID {
+			continue
+		}
+		err := deleteRefreshTokenFamily(tx, familyID)
+		if err != nil {
+			return 0, err
 		}
+		revoked++
 	}
+	return revoked, nil
+}
 
-	if keyToDelete == -1 {
-		errorMessage := fmt.Sprintf("refresh token = %v was not found", refreshToken)
-		return errors.New(errorMessage)
+func (db *DB) CreatePasswordResetToken(userID int) (PasswordResetToken, error) {
+	resetToken, err := NewPasswordResetToken(userID)
+	if err != nil {
+		return PasswordResetToken{}, err
 	}
 
-	delete(refreshTokens, keyToDelete)
+	err = db.Update(func(tx *Tx) error {
+		if _, exists := tx.User(userID); !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+
+		err := deletePasswordResetTokens(tx, userID)
+		if err != nil {
+			return err
+		}
 
-	err = db.writeDB(dbStructure)
+		resetToken.ID, err = tx.NextPasswordResetTokenID()
+		if err != nil {
+			return err
+		}
+		return tx.PutPasswordResetToken(*resetToken)
+	})
 	if err != nil {
-		return err
+		return PasswordResetToken{}, err
+	}
+
+	return *resetToken, nil
+}
+
+func (db *DB) ResetPassword(token, password string) (User, error) {
+	err := validatePassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	var updatedUser User
+	err = db.Update(func(tx *Tx) error {
+		resetToken, exists := tx.PasswordResetTokenByHash(hashToken(token))
+		if !exists || !time.Now().UTC().Before(resetToken.ExpiresAt) {
+			return notFoundError("the password reset token was not found or has expired")
+		}
+
+		user, exists := tx.User(resetToken.UserID)
+		if !exists {
+			return notFoundError("the user with id = %v was not found", resetToken.UserID)
+		}
+
+		err := deletePasswordResetTokens(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		_, err = deleteUserSessions(tx, user.ID, 0)
+		if err != nil {
+			return err
+		}
+
+		user.Password = hashedPassword
+		user.UpdatedAt = time.Now().UTC()
+		updatedUser = user
+		return tx.PutUser(user)
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return updatedUser, nil
+}
+
+func (db *DB) DeleteExpiredPasswordResetTokens() (int, error) {
+	deleted := 0
+	err := db.Update(func(tx *Tx) error {
+		for _, resetToken := range tx.ExpiredPasswordResetTokens(time.Now().UTC()) {
+			err := tx.DeletePasswordResetToken(resetToken.ID)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
+	return deleted, nil
+}
+
+func deletePasswordResetTokens(tx *Tx, userID int) error {
+	for _, resetToken := range tx.PasswordResetTokensByUser(userID) {
+		err := tx.DeletePasswordResetToken(resetToken.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) DeleteExpiredRefreshTokens() (int, error) {
+	deleted := 0
+	err := db.Update(func(tx *Tx) error {
+		for _, refreshToken := range tx.ExpiredRefreshTokens(time.Now().UTC()) {
+			err := tx.DeleteRefreshToken(refreshToken.ID)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+// liveRefreshToken returns the token of a family that can still be
+// refreshed, if there is one. It is always the newest token of the family.
+func liveRefreshToken(tx *Tx, familyID int, now time.Time) (RefreshToken, bool) {
+	refreshTokens := tx.RefreshTokensByFamily(familyID)
+	if len(refreshTokens) == 0 {
+		return RefreshToken{}, false
+	}
+
+	newestRefToken := refreshTokens[len(refreshTokens)-1]
+	return newestRefToken, newestRefToken.isLive(now)
+}
+
+func deleteRefreshTokenFamily(tx *Tx, familyID int) error {
+	for _, refreshToken := range tx.RefreshTokensByFamily(familyID) {
+		err := tx.DeleteRefreshToken(refreshToken.ID)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (db *DB) ensureDB() error {
 	_, err := os.ReadFile(db.path)
 	if errors.Is(err, os.ErrNotExist) {
-		initialData, err := NewDBStructure(make(map[int]Chirp), make(map[int]User), make(map[int]RefreshToken))
+		initialData, err := NewDBStructure(make(map[int]Chirp), make(map[int]User), make(map[int]RefreshToken), make(map[int]ChirpRevision), make(map[int]Report), make(map[int]PasswordResetToken))
+		if err != nil {
+			return err
+		}
+		// A log left without its snapshot belongs to a database that is
+		// gone; replaying it over the new one would bring that data back.
+		err = db.removeLogLocked()
 		if err != nil {
 			return err
 		}
-		return db.writeDB(*initialData)
+		return db.writeSnapshotLocked(*initialData)
+	}
+	if err != nil {
+		return err
 	}
-	return err
-}
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+	// Fold any log left by the previous run into the snapshot so migrations
+	// see every committed mutation.
+	err = db.compact()
+	if err != nil {
+		return err
+	}
+	return db.migrate()
+}
 
+func (db *DB) writeSnapshotLocked(dbStructure DBStructure) error {
 	err := os.MkdirAll(filepath.Dir(db.path), os.ModePerm)
 	if err != nil {
 		return err
@@ -304,14 +1041,11 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 		return err
 	}
 
-	return os.WriteFile(db.path, data, 0644)
+	return atomicfile.WriteFile(db.path, data, 0644)
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
-	data, err := os.ReadFile(db.path)
+func (db *DB) readLocked() (DBStructure, error) {
+	data, err := db.readSnapshotLocked()
 	if err != nil {
 		return DBStructure{}, err
 	}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentCreateChirp creates chirps from many goroutines at once. Run
+// it with -race: every chirp must get its own ID, and all of them must be
+// there after reopening the file.
+func TestConcurrentCreateChirp(t *testing.T) {
+	const goroutines = 50
+
+	for _, options := range []Options{{}, {WAL: true, CompactEvery: 7}} {
+		t.Run(fmt.Sprintf("wal=%v", options.WAL), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			db, err := NewDBWithOptions(path, options)
+			if err != nil {
+				t.Fatalf("NewDBWithOptions: %v", err)
+			}
+			defer db.Close()
+
+			ids := make(chan int, goroutines)
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					chirp, err := db.CreateChirp(fmt.Sprintf("chirp %d", i), 1, false)
+					if err != nil {
+						t.Errorf("CreateChirp: %v", err)
+						return
+					}
+					ids <- chirp.ID
+				}(i)
+			}
+			wg.Wait()
+			close(ids)
+
+			seen := map[int]bool{}
+			for id := range ids {
+				if seen[id] {
+					t.Errorf("the ID %d was returned twice", id)
+				}
+				seen[id] = true
+			}
+			if len(seen) != goroutines {
+				t.Errorf("got %d IDs, want %d", len(seen), goroutines)
+			}
+
+			reopened, err := NewDBWithOptions(path, options)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer reopened.Close()
+
+			var chirps []Chirp
+			err = reopened.View(func(tx *Tx) error {
+				chirps = tx.Chirps()
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("View: %v", err)
+			}
+			if len(chirps) != goroutines {
+				t.Errorf("the database holds %d chirps, want %d", len(chirps), goroutines)
+			}
+			for _, chirp := range chirps {
+				if !seen[chirp.ID] {
+					t.Errorf("the stored chirp %d was never returned by CreateChirp", chirp.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"net/mail"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeEmail returns the key used to compare emails: NFKC-normalized and
+// case-folded, so "Bob@Example.com" and "bob@example.com" are the same
+// account.
+func NormalizeEmail(email string) string {
+	folded := cases.Fold().String(norm.NFKC.String(strings.TrimSpace(email)))
+	return norm.NFKC.String(folded)
+}
+
+// validateEmail checks that email is a bare RFC 5322 address (no display name
+// or angle brackets) and returns it without surrounding whitespace.
+func validateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", validationError("email", "the email is required")
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return "", validationError("email", "the email %q is not a valid address", email)
+	}
+
+	return email, nil
+}
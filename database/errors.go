@@ -0,0 +1,64 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Store methods wrap one of these kinds, so callers can
+// tell bad input and missing records apart from I/O failures with errors.Is.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+)
+
+var ErrEmailTaken = conflictError("the email is already taken")
+
+var ErrHandleTaken = conflictError("the handle is already taken")
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// exchanged is presented again, which means it was stolen or replayed.
+var ErrRefreshTokenReused = conflictError("the refresh token was already used")
+
+// ErrTOTPCodeReused is returned when a TOTP code is entered a second time.
+var ErrTOTPCodeReused = conflictError("the code was already used")
+
+// ValidationError reports which input field was rejected and why.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+func validationError(field, format string, args ...any) error {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+func notFoundError(format string, args ...any) error {
+	return &kindError{kind: ErrNotFound, message: fmt.Sprintf(format, args...)}
+}
+
+func conflictError(format string, args ...any) error {
+	return &kindError{kind: ErrConflict, message: fmt.Sprintf(format, args...)}
+}
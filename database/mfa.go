@@ -0,0 +1,72 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+)
+
+const (
+	recoveryCodeCount = 10
+	// recoveryCodeBytes is the randomness of a recovery code: 80 bits, which
+	// base32 spells in 16 characters.
+	recoveryCodeBytes = 10
+)
+
+// MFA is the two-factor authentication state of a user. It is turned on once
+// the user confirms a TOTP enrollment.
+type MFA struct {
+	// TOTPSecret is the secret of the confirmed enrollment.
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// PendingTOTPSecret is the secret of an enrollment that was not confirmed
+	// yet.
+	PendingTOTPSecret string `json:"pending_totp_secret,omitempty"`
+	// LastTOTPStep is the time step of the last accepted code, so that a code
+	// cannot be used twice.
+	LastTOTPStep int64 `json:"last_totp_step,omitempty"`
+	// RecoveryCodeHashes are the hashes of the recovery codes not used yet.
+	RecoveryCodeHashes []string `json:"recovery_code_hashes,omitempty"`
+}
+
+func (mfa MFA) Enabled() bool {
+	return mfa.TOTPSecret != ""
+}
+
+// NewRecoveryCodes returns a fresh set of single-use recovery codes and the
+// hashes to store for them.
+func NewRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		bytes := make([]byte, recoveryCodeBytes)
+		_, err := rand.Read(bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(bytes))
+		codes = append(codes, code[:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode hashes a recovery code the way it was typed, ignoring case,
+// dashes and spaces. Codes have too many random bits to be guessed from their
+// hashes, so like the other tokens they need no slow hash.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
+
+// removeRecoveryCode returns hashes without the hash of code, and whether it
+// was there.
+func removeRecoveryCode(hashes []string, code string) ([]string, bool) {
+	hash := hashRecoveryCode(code)
+	for i, stored := range hashes {
+		if stored == hash {
+			remaining := append([]string{}, hashes[:i]...)
+			return append(remaining, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
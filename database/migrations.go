@@ -0,0 +1,493 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Romasav/chirpy/atomicfile"
+)
+
+// Migration upgrades the JSON database file from Version-1 to Version. It
+// works on the decoded document rather than DBStructure so it can read fields
+// the current structs no longer have.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(doc map[string]any) error
+}
+
+// migrations must stay ordered by Version, starting at 1 with no gaps.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "initialize missing collections",
+		Apply: func(doc map[string]any) error {
+			for _, collection := range []string{"chirps", "users", "refresh_tokens"} {
+				if _, ok := doc[collection].(map[string]any); !ok {
+					doc[collection] = map[string]any{}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "seed ID sequences from the highest existing IDs",
+		Apply: func(doc map[string]any) error {
+			sequences := map[string]any{}
+			for _, collection := range []string{"chirps", "users"} {
+				highestID := 0
+				for key := range doc[collection].(map[string]any) {
+					id, err := strconv.Atoi(key)
+					if err != nil {
+						return fmt.Errorf("%s has non-numeric key %q", collection, key)
+					}
+					if id > highestID {
+						highestID = id
+					}
+				}
+				sequences[collection] = highestID
+			}
+			doc["sequences"] = sequences
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "backfill created_at and updated_at on chirps and users",
+		Apply: func(doc map[string]any) error {
+			// The real times are unknown; the migration time at least keeps
+			// existing records ordered by ID when sorted by time.
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			for _, collection := range []string{"chirps", "users"} {
+				for key, value := range doc[collection].(map[string]any) {
+					record, ok := value.(map[string]any)
+					if !ok {
+						return fmt.Errorf("%s[%s] is not an object", collection, key)
+					}
+					for _, field := range []string{"created_at", "updated_at"} {
+						if _, exists := record[field]; !exists {
+							record[field] = now
+						}
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "add the chirp_revisions collection",
+		Apply: func(doc map[string]any) error {
+			if _, ok := doc["chirp_revisions"].(map[string]any); !ok {
+				doc["chirp_revisions"] = map[string]any{}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "add the reports collection",
+		Apply: func(doc map[string]any) error {
+			if _, ok := doc["reports"].(map[string]any); !ok {
+				doc["reports"] = map[string]any{}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "add roles to users",
+		Apply: func(doc map[string]any) error {
+			for key, value := range doc["users"].(map[string]any) {
+				user, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("users[%s] is not an object", key)
+				}
+				if _, exists := user["roles"]; !exists {
+					user["roles"] = []any{}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "key refresh tokens by ID and group them into families",
+		Apply: func(doc map[string]any) error {
+			// Tokens were keyed by user ID, one per user. Each becomes its
+			// own family.
+			oldTokens := doc["refresh_tokens"].(map[string]any)
+			userIDs := []int{}
+			for key := range oldTokens {
+				userID, err := strconv.Atoi(key)
+				if err != nil {
+					return fmt.Errorf("refresh_tokens has non-numeric key %q", key)
+				}
+				userIDs = append(userIDs, userID)
+			}
+			sort.Ints(userIDs)
+
+			newTokens := map[string]any{}
+			for i, userID := range userIDs {
+				key := strconv.Itoa(userID)
+				token, ok := oldTokens[key].(map[string]any)
+				if !ok {
+					return fmt.Errorf("refresh_tokens[%s] is not an object", key)
+				}
+				id := i + 1
+				token["id"] = id
+				token["family_id"] = id
+				newTokens[strconv.Itoa(id)] = token
+			}
+			doc["refresh_tokens"] = newTokens
+
+			sequences, ok := doc["sequences"].(map[string]any)
+			if !ok {
+				return fmt.Errorf("sequences is not an object")
+			}
+			sequences["refresh_tokens"] = len(userIDs)
+			return nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "record the client and times of refresh tokens",
+		Apply: func(doc map[string]any) error {
+			// A token was issued refreshTokenLifetime before it expires, and
+			// its family was started when the oldest token still kept was
+			// issued.
+			tokens := doc["refresh_tokens"].(map[string]any)
+			issuedAt := map[string]time.Time{}
+			familyCreatedAt := map[string]time.Time{}
+			for key, value := range tokens {
+				token, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("refresh_tokens[%s] is not an object", key)
+				}
+				rawExpiresAt, _ := token["expires_at"].(string)
+				expiresAt, err := time.Parse(time.RFC3339Nano, rawExpiresAt)
+				if err != nil {
+					return fmt.Errorf("refresh_tokens[%s] has an invalid expires_at: %w", key, err)
+				}
+				issuedAt[key] = expiresAt.Add(-refreshTokenLifetime)
+
+				familyID := fmt.Sprint(token["family_id"])
+				if createdAt, seen := familyCreatedAt[familyID]; !seen || issuedAt[key].Before(createdAt) {
+					familyCreatedAt[familyID] = issuedAt[key]
+				}
+			}
+
+			for key, value := range tokens {
+				token := value.(map[string]any)
+				if _, exists := token["created_at"]; !exists {
+					token["created_at"] = familyCreatedAt[fmt.Sprint(token["family_id"])].Format(time.RFC3339Nano)
+				}
+				if _, exists := token["last_used_at"]; !exists {
+					token["last_used_at"] = issuedAt[key].Format(time.RFC3339Nano)
+				}
+				for _, field := range []string{"user_agent", "ip"} {
+					if _, exists := token[field]; !exists {
+						token[field] = ""
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     9,
+		Description: "store refresh tokens as SHA-256 hashes",
+		Apply: func(doc map[string]any) error {
+			for key, value := range doc["refresh_tokens"].(map[string]any) {
+				token, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("refresh_tokens[%s] is not an object", key)
+				}
+				plaintext, ok := token["token"].(string)
+				if !ok {
+					return fmt.Errorf("refresh_tokens[%s] has no token", key)
+				}
+				token["token_hash"] = hashToken(plaintext)
+				delete(token, "token")
+			}
+			return nil
+		},
+	},
+	{
+		Version:     10,
+		Description: "add the password_reset_tokens collection",
+		Apply: func(doc map[string]any) error {
+			if _, ok := doc["password_reset_tokens"].(map[string]any); !ok {
+				doc["password_reset_tokens"] = map[string]any{}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     11,
+		Description: "mark existing users as verified",
+		Apply: func(doc map[string]any) error {
+			// Accounts created before verification existed are trusted.
+			for key, value := range doc["users"].(map[string]any) {
+				user, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("users[%s] is not an object", key)
+				}
+				if _, exists := user["verified"]; !exists {
+					user["verified"] = true
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     12,
+		Description: "give existing users a handle",
+		Apply: func(doc map[string]any) error {
+			// The handles new users get, which nobody else can take.
+			for key, value := range doc["users"].(map[string]any) {
+				user, ok := value.(map[string]any)
+				if !ok {
+					return fmt.Errorf("users[%s] is not an object", key)
+				}
+				if _, exists := user["handle"]; !exists {
+					user["handle"] = defaultHandlePrefix + key
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// LatestSchemaVersion is the schema version written by this build.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+type MigrationReport struct {
+	Path        string
+	FromVersion int
+	ToVersion   int
+	Steps       []MigrationStep
+}
+
+type MigrationStep struct {
+	Version     int
+	Description string
+	Changes     []string
+}
+
+func (report MigrationReport) String() string {
+	if report.FromVersion == report.ToVersion {
+		return fmt.Sprintf("%s is at schema version %d, nothing to migrate\n", report.Path, report.FromVersion)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: schema version %d -> %d\n", report.Path, report.FromVersion, report.ToVersion)
+	for _, step := range report.Steps {
+		fmt.Fprintf(&buf, "  %d: %s\n", step.Version, step.Description)
+		for _, change := range step.Changes {
+			fmt.Fprintf(&buf, "       %s\n", change)
+		}
+	}
+	return buf.String()
+}
+
+// planJSONMigrations reports what NewDB would change in the file at path
+// without writing anything.
+func planJSONMigrations(path string) (MigrationReport, error) {
+	db := DB{path: path}
+	data, err := db.readSnapshotLocked()
+	if errors.Is(err, os.ErrNotExist) {
+		latest := LatestSchemaVersion()
+		return MigrationReport{Path: path, FromVersion: latest, ToVersion: latest}, nil
+	}
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	_, report, err := runMigrations(path, data)
+	return report, err
+}
+
+func (db *DB) migrate() error {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+
+	migrated, report, err := runMigrations(db.path, data)
+	if err != nil {
+		return err
+	}
+	if report.FromVersion == report.ToVersion {
+		return nil
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", db.path, report.FromVersion, time.Now().UTC().Format("20060102T150405Z"))
+	err = atomicfile.WriteFile(backupPath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("could not back up database before migrating: %w", err)
+	}
+
+	return atomicfile.WriteFile(db.path, migrated, 0644)
+}
+
+func runMigrations(path string, data []byte) ([]byte, MigrationReport, error) {
+	doc, err := decodeDocument(data)
+	if err != nil {
+		return nil, MigrationReport{}, err
+	}
+
+	fromVersion, err := documentVersion(doc)
+	if err != nil {
+		return nil, MigrationReport{}, err
+	}
+
+	report := MigrationReport{
+		Path:        path,
+		FromVersion: fromVersion,
+		ToVersion:   LatestSchemaVersion(),
+	}
+	if fromVersion > report.ToVersion {
+		return nil, report, fmt.Errorf("database schema version %d is newer than the latest supported version %d", fromVersion, report.ToVersion)
+	}
+	if fromVersion == report.ToVersion {
+		return data, report, nil
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= fromVersion {
+			continue
+		}
+
+		before, err := cloneDocument(doc)
+		if err != nil {
+			return nil, report, err
+		}
+
+		err = migration.Apply(doc)
+		if err != nil {
+			return nil, report, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		doc["schema_version"] = migration.Version
+
+		report.Steps = append(report.Steps, MigrationStep{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Changes:     diffDocuments(before, doc),
+		})
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, report, err
+	}
+
+	return migrated, report, nil
+}
+
+func decodeDocument(data []byte) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	doc := map[string]any{}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func cloneDocument(doc map[string]any) (map[string]any, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocument(data)
+}
+
+func documentVersion(doc map[string]any) (int, error) {
+	rawVersion, exists := doc["schema_version"]
+	if !exists {
+		return 0, nil
+	}
+
+	number, ok := rawVersion.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("schema_version has unexpected type %T", rawVersion)
+	}
+	version, err := number.Int64()
+	if err != nil {
+		return 0, fmt.Errorf("schema_version is not an integer: %w", err)
+	}
+	return int(version), nil
+}
+
+// diffDocuments summarizes, per top-level key, how many records a migration
+// added, removed or rewrote.
+func diffDocuments(before, after map[string]any) []string {
+	keys := map[string]bool{}
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	delete(keys, "schema_version")
+
+	sortedKeys := []string{}
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+
+	changes := []string{}
+	for _, key := range sortedKeys {
+		oldValue, hadKey := before[key]
+		newValue, hasKey := after[key]
+
+		oldCollection, oldIsMap := oldValue.(map[string]any)
+		newCollection, newIsMap := newValue.(map[string]any)
+		if !oldIsMap || !newIsMap {
+			switch {
+			case !hadKey:
+				changes = append(changes, fmt.Sprintf("%s: added", key))
+			case !hasKey:
+				changes = append(changes, fmt.Sprintf("%s: removed", key))
+			case !reflect.DeepEqual(oldValue, newValue):
+				changes = append(changes, fmt.Sprintf("%s: changed", key))
+			}
+			continue
+		}
+
+		added, removed, changed := 0, 0, 0
+		for recordKey, newRecord := range newCollection {
+			oldRecord, exists := oldCollection[recordKey]
+			if !exists {
+				added++
+			} else if !reflect.DeepEqual(oldRecord, newRecord) {
+				changed++
+			}
+		}
+		for recordKey := range oldCollection {
+			if _, exists := newCollection[recordKey]; !exists {
+				removed++
+			}
+		}
+
+		if added+removed+changed > 0 {
+			changes = append(changes, fmt.Sprintf("%s: %d added, %d removed, %d changed", key, added, removed, changed))
+		}
+	}
+
+	return changes
+}
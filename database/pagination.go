@@ -0,0 +1,189 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultChirpPageSize = 50
+	MaxChirpPageSize     = 100
+)
+
+const (
+	OrderByID        = "id"
+	OrderByCreatedAt = "created_at"
+)
+
+// ChirpQuery selects one page of chirps. Pages are keyed on the sort key
+// (ties broken by ID), so a cursor keeps pointing at the same place when
+// chirps are added or deleted.
+type ChirpQuery struct {
+	// AuthorID limits the page to one author; 0 means every author.
+	AuthorID int
+	// OrderBy is OrderByID (the default) or OrderByCreatedAt.
+	OrderBy    string
+	Descending bool
+	// Since and Until bound created_at to [Since, Until); zero means unbounded.
+	Since time.Time
+	Until time.Time
+	// FlaggedOnly limits the page to chirps flagged for review.
+	FlaggedOnly bool
+	// IncludeHidden also returns chirps hidden by a moderator.
+	IncludeHidden bool
+	Limit         int
+	// Cursor is the NextCursor of the previous page, or "" for the first page.
+	Cursor string
+}
+
+type ChirpPage struct {
+	Chirps []Chirp
+	// NextCursor is empty on the last page.
+	NextCursor string
+}
+
+type chirpCursor struct {
+	ID        int        `json:"id"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+func (query ChirpQuery) limit() int {
+	if query.Limit <= 0 {
+		return DefaultChirpPageSize
+	}
+	if query.Limit > MaxChirpPageSize {
+		return MaxChirpPageSize
+	}
+	return query.Limit
+}
+
+func (query ChirpQuery) orderBy() (string, error) {
+	switch query.OrderBy {
+	case "", OrderByID:
+		return OrderByID, nil
+	case OrderByCreatedAt:
+		return OrderByCreatedAt, nil
+	default:
+		return "", validationError("sort_by", "cannot sort chirps by %q", query.OrderBy)
+	}
+}
+
+// matches applies the filters of query that are not covered by the index.
+func (query ChirpQuery) matches(chirp Chirp) bool {
+	if query.FlaggedOnly && !chirp.Flagged {
+		return false
+	}
+	if chirp.Hidden && !query.IncludeHidden {
+		return false
+	}
+	if !query.Since.IsZero() && chirp.CreatedAt.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !chirp.CreatedAt.Before(query.Until) {
+		return false
+	}
+	return true
+}
+
+// chirpLess orders chirps by orderBy, breaking ties by ID.
+func chirpLess(orderBy string) func(a, b Chirp) bool {
+	if orderBy == OrderByCreatedAt {
+		return func(a, b Chirp) bool {
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+			return a.ID < b.ID
+		}
+	}
+	return func(a, b Chirp) bool {
+		return a.ID < b.ID
+	}
+}
+
+func encodeChirpCursor(chirp Chirp, orderBy string) string {
+	cursor := chirpCursor{ID: chirp.ID}
+	if orderBy == OrderByCreatedAt {
+		createdAt := chirp.CreatedAt
+		cursor.CreatedAt = &createdAt
+	}
+
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeChirpCursor returns the position the cursor points at as a chirp
+// carrying only the sort key, or nil for the first page.
+func decodeChirpCursor(cursor string, orderBy string) (*Chirp, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, validationError("cursor", "the cursor is invalid")
+	}
+
+	var decoded chirpCursor
+	err = json.Unmarshal(data, &decoded)
+	if err != nil || decoded.ID <= 0 {
+		return nil, validationError("cursor", "the cursor is invalid")
+	}
+	if (orderBy == OrderByCreatedAt) != (decoded.CreatedAt != nil) {
+		return nil, validationError("cursor", "the cursor belongs to a different sort order")
+	}
+
+	position := Chirp{ID: decoded.ID}
+	if decoded.CreatedAt != nil {
+		position.CreatedAt = *decoded.CreatedAt
+	}
+	return &position, nil
+}
+
+// pageChirps walks ids, which are sorted ascending by the query order, from
+// the cursor in the requested direction and returns the next page of chirps
+// matching the query, and whether more follow.
+func pageChirps(ids []int, chirps map[int]Chirp, query ChirpQuery, orderBy string, cursor *Chirp) ([]Chirp, bool) {
+	less := chirpLess(orderBy)
+	limit := query.limit()
+	at := func(i int) Chirp {
+		return chirps[ids[i]]
+	}
+
+	page := []Chirp{}
+	collect := func(chirp Chirp) bool {
+		if !query.matches(chirp) {
+			return true
+		}
+		if len(page) == limit {
+			return false
+		}
+		page = append(page, chirp)
+		return true
+	}
+
+	if !query.Descending {
+		start := 0
+		if cursor != nil {
+			start = sort.Search(len(ids), func(i int) bool { return less(*cursor, at(i)) })
+		}
+		for i := start; i < len(ids); i++ {
+			if !collect(at(i)) {
+				return page, true
+			}
+		}
+		return page, false
+	}
+
+	end := len(ids)
+	if cursor != nil {
+		end = sort.Search(len(ids), func(i int) bool { return !less(at(i), *cursor) })
+	}
+	for i := end - 1; i >= 0; i-- {
+		if !collect(at(i)) {
+			return page, true
+		}
+	}
+	return page, false
+}
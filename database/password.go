@@ -0,0 +1,238 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The algorithms passwords can be hashed with.
+const (
+	PasswordArgon2id = "argon2id"
+	PasswordBcrypt   = "bcrypt"
+)
+
+// bcryptMaxLength is the number of bytes bcrypt hashes; it refuses longer
+// passwords rather than checking only part of them.
+const bcryptMaxLength = 72
+
+// PasswordConfig decides how new passwords are hashed and which passwords are
+// accepted.
+type PasswordConfig struct {
+	Algorithm  string
+	Argon2id   Argon2idParams
+	BcryptCost int
+	Policy     PasswordPolicy
+}
+
+// Argon2idParams are the cost parameters of Argon2id (RFC 9106).
+type Argon2idParams struct {
+	// Memory is in KiB.
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// PasswordPolicy is what a new password must look like. Passwords set before
+// the policy changed keep working.
+type PasswordPolicy struct {
+	// MinLength and MaxLength count characters.
+	MinLength int
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and other characters a password must mix.
+	MinClasses int
+}
+
+const (
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+// DefaultPasswordConfig hashes with Argon2id at the parameters OWASP
+// recommends and asks for at least 8 characters.
+func DefaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{
+		Algorithm:  PasswordArgon2id,
+		Argon2id:   Argon2idParams{Memory: 19 * 1024, Time: 2, Threads: 1},
+		BcryptCost: bcrypt.DefaultCost,
+		Policy:     PasswordPolicy{MinLength: 8, MaxLength: 256, MinClasses: 1},
+	}
+}
+
+var (
+	passwordConfig = DefaultPasswordConfig()
+	// dummyPasswordHash stands in for the password of a user that does not
+	// exist.
+	dummyPasswordHash = mustHashPassword("chirpy")
+)
+
+// SetPasswordConfig replaces the password settings. Call it before opening
+// the database.
+func SetPasswordConfig(config PasswordConfig) error {
+	switch config.Algorithm {
+	case PasswordArgon2id:
+		if config.Argon2id.Memory < 8*uint32(config.Argon2id.Threads) || config.Argon2id.Time < 1 || config.Argon2id.Threads < 1 {
+			return fmt.Errorf("invalid argon2id parameters %+v", config.Argon2id)
+		}
+	case PasswordBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("the bcrypt cost %d is not between %d and %d", config.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", config.Algorithm)
+	}
+	if config.Policy.MinLength < 1 || config.Policy.MaxLength < config.Policy.MinLength {
+		return fmt.Errorf("invalid password lengths %d to %d", config.Policy.MinLength, config.Policy.MaxLength)
+	}
+	if config.Policy.MinClasses < 0 || config.Policy.MinClasses > 4 {
+		return fmt.Errorf("the password classes %d are not between 0 and 4", config.Policy.MinClasses)
+	}
+
+	passwordConfig = config
+	dummyPasswordHash = mustHashPassword("chirpy")
+	return nil
+}
+
+// validatePassword checks a new password against the policy.
+func validatePassword(password string) error {
+	policy := passwordConfig.Policy
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		return validationError("password", "the password must be at least %v characters long", policy.MinLength)
+	}
+	if length > policy.MaxLength {
+		return validationError("password", "the password must be at most %v characters long", policy.MaxLength)
+	}
+	if passwordConfig.Algorithm == PasswordBcrypt && len(password) > bcryptMaxLength {
+		return validationError("password", "the password must be at most %v bytes long", bcryptMaxLength)
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	if classes < policy.MinClasses {
+		return validationError("password", "the password must mix at least %v of lowercase letters, uppercase letters, digits and symbols", policy.MinClasses)
+	}
+	return nil
+}
+
+// hashPassword hashes password with the current settings, in PHC string
+// format for Argon2id and in the usual $2b$ format for bcrypt.
+func hashPassword(password string) (string, error) {
+	if passwordConfig.Algorithm == PasswordBcrypt {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), passwordConfig.BcryptCost)
+		if err != nil {
+			return "", errors.New("error hashing the password")
+		}
+		return string(hashedPassword), nil
+	}
+
+	salt := make([]byte, argon2idSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.New("error hashing the password")
+	}
+	params := passwordConfig.Argon2id
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, argon2idKeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func mustHashPassword(password string) string {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+	return hashedPassword
+}
+
+// argon2idHash is a parsed Argon2id PHC string.
+type argon2idHash struct {
+	params Argon2idParams
+	salt   []byte
+	key    []byte
+}
+
+func parseArgon2idHash(hash string) (argon2idHash, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != PasswordArgon2id {
+		return argon2idHash{}, errors.New("not an argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(fields[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return argon2idHash{}, errors.New("unsupported argon2id version")
+	}
+
+	parsed := argon2idHash{}
+	_, err = fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &parsed.params.Memory, &parsed.params.Time, &parsed.params.Threads)
+	if err != nil {
+		return argon2idHash{}, errors.New("invalid argon2id parameters")
+	}
+	parsed.salt, err = base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return argon2idHash{}, errors.New("invalid argon2id salt")
+	}
+	parsed.key, err = base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(parsed.key) == 0 {
+		return argon2idHash{}, errors.New("invalid argon2id key")
+	}
+	return parsed, nil
+}
+
+// comparePasswordHash reports whether password matches hash, which may have
+// been made with any supported algorithm and parameters.
+func comparePasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$"+PasswordArgon2id+"$") {
+		parsed, err := parseArgon2idHash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey([]byte(password), parsed.salt, parsed.params.Time, parsed.params.Memory, parsed.params.Threads, uint32(len(parsed.key)))
+		return subtle.ConstantTimeCompare(key, parsed.key) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// passwordHashOutdated reports whether hash was made with other settings than
+// the current ones.
+func passwordHashOutdated(hash string) bool {
+	if passwordConfig.Algorithm == PasswordBcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != passwordConfig.BcryptCost
+	}
+
+	parsed, err := parseArgon2idHash(hash)
+	return err != nil || parsed.params != passwordConfig.Argon2id || len(parsed.key) != argon2idKeyLength
+}
@@ -0,0 +1,34 @@
+package database
+
+import "time"
+
+const passwordResetTokenLifetime = 30 * time.Minute
+
+// PasswordResetToken lets a user who forgot their password set a new one. It
+// works once, and only the latest token of a user is kept.
+type PasswordResetToken struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+	// Token is only set on a token that was just issued; only its hash is
+	// stored.
+	Token     string    `json:"-"`
+	TokenHash string    `json:"token_hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewPasswordResetToken(userID int) (*PasswordResetToken, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &PasswordResetToken{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(passwordResetTokenLifetime),
+		CreatedAt: now,
+	}, nil
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2id keeps the tests fast.
+var cheapArgon2id = Argon2idParams{Memory: 64, Time: 1, Threads: 1}
+
+// setPasswordConfig replaces the password settings for the rest of the test.
+func setPasswordConfig(t *testing.T, config PasswordConfig) {
+	t.Helper()
+	err := SetPasswordConfig(config)
+	if err != nil {
+		t.Fatalf("SetPasswordConfig: %v", err)
+	}
+	t.Cleanup(func() {
+		SetPasswordConfig(DefaultPasswordConfig())
+	})
+}
+
+func TestParseArgon2idHash(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name       string
+		hash       string
+		wantParams Argon2idParams
+		wantErr    bool
+	}{
+		{"valid", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + key, Argon2idParams{Memory: 19456, Time: 2, Threads: 1}, false},
+		{"other algorithm", "$argon2i$v=19$m=19456,t=2,p=1$" + salt + "$" + key, Argon2idParams{}, true},
+		{"other version", "$argon2id$v=16$m=19456,t=2,p=1$" + salt + "$" + key, Argon2idParams{}, true},
+		{"missing parameters", "$argon2id$v=19$m=19456$" + salt + "$" + key, Argon2idParams{}, true},
+		{"invalid salt", "$argon2id$v=19$m=19456,t=2,p=1$not*base64$" + key, Argon2idParams{}, true},
+		{"empty key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$", Argon2idParams{}, true},
+		{"missing field", "$argon2id$v=19$m=19456,t=2,p=1$" + salt, Argon2idParams{}, true},
+		{"bcrypt", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", Argon2idParams{}, true},
+	}
+	for _, test := range tests {
+		parsed, err := parseArgon2idHash(test.hash)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: parseArgon2idHash error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if parsed.params != test.wantParams {
+			t.Errorf("%s: parameters %+v, want %+v", test.name, parsed.params, test.wantParams)
+		}
+	}
+}
+
+// TestComparePasswordHash checks passwords against hashes of every supported
+// algorithm, whatever the current settings are.
+func TestComparePasswordHash(t *testing.T) {
+	setPasswordConfig(t, PasswordConfig{Algorithm: PasswordArgon2id, Argon2id: cheapArgon2id, Policy: DefaultPasswordConfig().Policy})
+	argon2idHash := mustHashPassword("correct horse")
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"argon2id", argon2idHash, "correct horse", true},
+		{"argon2id, wrong password", argon2idHash, "battery staple", false},
+		{"bcrypt", string(bcryptHash), "correct horse", true},
+		{"bcrypt, wrong password", string(bcryptHash), "battery staple", false},
+		{"corrupt argon2id", strings.Replace(argon2idHash, "v=19", "v=x", 1), "correct horse", false},
+		{"empty", "", "", false},
+	}
+	for _, test := range tests {
+		if got := comparePasswordHash(test.hash, test.password); got != test.want {
+			t.Errorf("%s: comparePasswordHash = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestPasswordHashOutdated marks hashes made with other settings than the
+// current ones for rehashing.
+func TestPasswordHashOutdated(t *testing.T) {
+	policy := DefaultPasswordConfig().Policy
+	argon2id := PasswordConfig{Algorithm: PasswordArgon2id, Argon2id: cheapArgon2id, Policy: policy}
+	stronger := PasswordConfig{Algorithm: PasswordArgon2id, Argon2id: Argon2idParams{Memory: 128, Time: 1, Threads: 1}, Policy: policy}
+	bcryptMin := PasswordConfig{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost, Policy: policy}
+	bcryptMore := PasswordConfig{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost + 1, Policy: policy}
+
+	tests := []struct {
+		name    string
+		hashed  PasswordConfig
+		current PasswordConfig
+		want    bool
+	}{
+		{"same argon2id parameters", argon2id, argon2id, false},
+		{"other argon2id parameters", argon2id, stronger, true},
+		{"argon2id to bcrypt", argon2id, bcryptMin, true},
+		{"same bcrypt cost", bcryptMin, bcryptMin, false},
+		{"other bcrypt cost", bcryptMin, bcryptMore, true},
+		{"bcrypt to argon2id", bcryptMin, argon2id, true},
+	}
+	for _, test := range tests {
+		setPasswordConfig(t, test.hashed)
+		hash := mustHashPassword("correct horse")
+		setPasswordConfig(t, test.current)
+
+		if got := passwordHashOutdated(hash); got != test.want {
+			t.Errorf("%s: passwordHashOutdated = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestRehashPassword upgrades the hash of a user to the current settings, and
+// leaves a password that was changed in the meantime alone.
+func TestRehashPassword(t *testing.T) {
+	policy := DefaultPasswordConfig().Policy
+	forEachStore(t, func(t *testing.T, db Store) {
+		setPasswordConfig(t, PasswordConfig{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost, Policy: policy})
+		user := createTestUser(t, db)
+
+		setPasswordConfig(t, PasswordConfig{Algorithm: PasswordArgon2id, Argon2id: cheapArgon2id, Policy: policy})
+		if !user.PasswordNeedsRehash() {
+			t.Fatalf("a bcrypt hash does not need rehashing under argon2id")
+		}
+
+		err := db.RehashPassword(user.ID, "an older hash", "correct horse")
+		if err != nil {
+			t.Fatalf("RehashPassword: %v", err)
+		}
+		unchanged, err := db.GetUserByID(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+		if unchanged.Password != user.Password {
+			t.Errorf("RehashPassword replaced a hash it was not given")
+		}
+
+		err = db.RehashPassword(user.ID, user.Password, "correct horse")
+		if err != nil {
+			t.Fatalf("RehashPassword: %v", err)
+		}
+		rehashed, err := db.GetUserByID(user.ID)
+		if err != nil {
+			t.Fatalf("GetUserByID: %v", err)
+		}
+		if !strings.HasPrefix(rehashed.Password, "$argon2id$") || rehashed.PasswordNeedsRehash() {
+			t.Errorf("the hash %q was not upgraded", rehashed.Password)
+		}
+		if err := rehashed.ComparePassword("correct horse"); err != nil {
+			t.Errorf("ComparePassword after rehashing: %v", err)
+		}
+	})
+}
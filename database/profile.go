@@ -0,0 +1,172 @@
+package database
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	HandleMinLength      = 3
+	HandleMaxLength      = 20
+	DisplayNameMaxLength = 50
+	BioMaxLength         = 160
+	AvatarURLMaxLength   = 2048
+)
+
+// defaultHandlePrefix starts the handle every user gets when they sign up,
+// followed by their ID. Nobody else can take such a handle.
+const defaultHandlePrefix = "user"
+
+var (
+	handlePattern        = regexp.MustCompile(`^[a-z0-9_]+$`)
+	defaultHandlePattern = regexp.MustCompile(`^` + defaultHandlePrefix + `[0-9]+$`)
+	// reservedHandles would clash with the routes under /api/users; "me" is
+	// already too short.
+	reservedHandles = map[string]bool{"verify": true}
+)
+
+// Profile is what anyone can see of a user.
+type Profile struct {
+	UserID      int
+	Handle      string
+	DisplayName string
+	Bio         string
+	AvatarURL   string
+	CreatedAt   time.Time
+	// ChirpCount leaves out hidden chirps.
+	ChirpCount int
+}
+
+func (user *User) profile(chirpCount int) Profile {
+	return Profile{
+		UserID:      user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		CreatedAt:   user.CreatedAt,
+		ChirpCount:  chirpCount,
+	}
+}
+
+// NormalizeHandle returns the key used to look handles up: lowercase and
+// without a leading "@", so "@Bob" finds "bob".
+func NormalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+}
+
+func defaultHandle(userID int) string {
+	return defaultHandlePrefix + strconv.Itoa(userID)
+}
+
+// validateHandle checks a handle chosen by the user with userID and returns it
+// normalized.
+func validateHandle(handle string, userID int) (string, error) {
+	handle = NormalizeHandle(handle)
+	length := len(handle)
+	if length < HandleMinLength || length > HandleMaxLength {
+		return "", validationError("handle", "the handle must be %v to %v characters long", HandleMinLength, HandleMaxLength)
+	}
+	if !handlePattern.MatchString(handle) {
+		return "", validationError("handle", "the handle may only contain letters, digits and underscores")
+	}
+	if reservedHandles[handle] || (defaultHandlePattern.MatchString(handle) && handle != defaultHandle(userID)) {
+		return "", validationError("handle", "the handle %q is reserved", handle)
+	}
+	return handle, nil
+}
+
+func validateDisplayName(displayName string) (string, error) {
+	displayName = strings.TrimSpace(displayName)
+	if utf8.RuneCountInString(displayName) > DisplayNameMaxLength {
+		return "", validationError("display_name", "the display name must be at most %v characters long", DisplayNameMaxLength)
+	}
+	if strings.IndexFunc(displayName, unicode.IsControl) >= 0 {
+		return "", validationError("display_name", "the display name must be a single line of text")
+	}
+	return displayName, nil
+}
+
+func validateBio(bio string) (string, error) {
+	bio = strings.TrimSpace(bio)
+	if utf8.RuneCountInString(bio) > BioMaxLength {
+		return "", validationError("bio", "the bio must be at most %v characters long", BioMaxLength)
+	}
+	return bio, nil
+}
+
+// validateAvatarURL accepts an absolute http or https URL, or an empty string
+// to remove the avatar.
+func validateAvatarURL(avatarURL string) (string, error) {
+	avatarURL = strings.TrimSpace(avatarURL)
+	if avatarURL == "" {
+		return "", nil
+	}
+	if len(avatarURL) > AvatarURLMaxLength {
+		return "", validationError("avatar_url", "the avatar URL must be at most %v bytes long", AvatarURLMaxLength)
+	}
+
+	parsed, err := url.Parse(avatarURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.User != nil {
+		return "", validationError("avatar_url", "the avatar URL must be an http or https URL")
+	}
+	return avatarURL, nil
+}
+
+// validatedPatch is a UserPatch with its fields validated and the password
+// hashed, ready to be applied inside a transaction.
+type validatedPatch struct {
+	email, hashedPassword, handle, displayName, bio, avatarURL string
+}
+
+func validateUserPatch(userID int, patch UserPatch) (validatedPatch, error) {
+	var validated validatedPatch
+	var err error
+	if patch.Email != nil {
+		validated.email, err = validateEmail(*patch.Email)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+	}
+	if patch.Handle != nil {
+		validated.handle, err = validateHandle(*patch.Handle, userID)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+	}
+	if patch.DisplayName != nil {
+		validated.displayName, err = validateDisplayName(*patch.DisplayName)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+	}
+	if patch.Bio != nil {
+		validated.bio, err = validateBio(*patch.Bio)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+	}
+	if patch.AvatarURL != nil {
+		validated.avatarURL, err = validateAvatarURL(*patch.AvatarURL)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+	}
+	// Hash last; it is slow and pointless if another field is invalid.
+	if patch.Password != nil {
+		err = validatePassword(*patch.Password)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+		validated.hashedPassword, err = hashPassword(*patch.Password)
+		if err != nil {
+			return validatedPatch{}, err
+		}
+	}
+	return validated, nil
+}
@@ -1,38 +1,114 @@
 package database
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"sort"
 	"time"
+	"unicode/utf8"
 )
 
+const (
+	refreshTokenLifetime = 60 * 24 * time.Hour
+	// maxUserAgentLength caps what is kept of the client's User-Agent header.
+	maxUserAgentLength = 256
+)
+
+// RefreshToken is one link of a token family. A login starts a family, and
+// every refresh exchanges the current token for the next one of the family.
+// A family is what users see as a session.
 type RefreshToken struct {
-	UserID    int       `json:"user_id"`
-	Token     string    `json:"token"`
+	ID int `json:"id"`
+	// FamilyID is the ID of the token issued at login.
+	FamilyID int `json:"family_id"`
+	UserID   int `json:"user_id"`
+	// Token is only set on a token that was just issued. Only its hash is
+	// stored, so reading the database does not give access to any account.
+	Token     string    `json:"-"`
+	TokenHash string    `json:"token_hash"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// RotatedAt is set once the token has been exchanged. The token is kept
+	// until it expires so that presenting it again is detected as reuse.
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	// CreatedAt is when the family was started and is carried over to every
+	// token of it. LastUsedAt, UserAgent and IP describe the login or
+	// refresh that issued this token.
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// Session is the live token of a family, without the token itself.
+type Session struct {
+	ID         int       `json:"id"`
+	UserID     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
 }
 
-func NewRefreshToken(id int) (*RefreshToken, error) {
-	token, err := generateRefreshToken()
+// NewRefreshToken creates a token issued now. createdAt is the start of the
+// family, or the zero time to start a new one.
+func NewRefreshToken(userID, familyID int, createdAt time.Time, userAgent, ip string) (*RefreshToken, error) {
+	token, err := generateToken()
 	if err != nil {
 		return nil, err
 	}
 
-	expiresAt := time.Now().Add(60 * 24 * time.Hour)
+	now := time.Now().UTC()
+	if createdAt.IsZero() {
+		createdAt = now
+	}
 
 	return &RefreshToken{
-		UserID:    id,
-		Token:     token,
-		ExpiresAt: expiresAt,
+		FamilyID:   familyID,
+		UserID:     userID,
+		Token:      token,
+		TokenHash:  hashToken(token),
+		ExpiresAt:  now.Add(refreshTokenLifetime),
+		CreatedAt:  createdAt,
+		LastUsedAt: now,
+		UserAgent:  truncateUserAgent(userAgent),
+		IP:         ip,
 	}, nil
 }
 
-func generateRefreshToken() (string, error) {
-	bytes := make([]byte, 32)
-	_, err := rand.Read(bytes)
-	if err != nil {
-		return "", err
+// isLive reports whether the token is the current, unexpired token of its
+// family.
+func (refreshToken RefreshToken) isLive(now time.Time) bool {
+	return refreshToken.RotatedAt == nil && now.Before(refreshToken.ExpiresAt)
+}
+
+func (refreshToken RefreshToken) session() Session {
+	return Session{
+		ID:         refreshToken.FamilyID,
+		UserID:     refreshToken.UserID,
+		CreatedAt:  refreshToken.CreatedAt,
+		LastUsedAt: refreshToken.LastUsedAt,
+		ExpiresAt:  refreshToken.ExpiresAt,
+		UserAgent:  refreshToken.UserAgent,
+		IP:         refreshToken.IP,
 	}
+}
+
+// sortSessions orders sessions by last use, newest first.
+func sortSessions(sessions []Session) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+}
 
-	return hex.EncodeToString(bytes), nil
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) <= maxUserAgentLength {
+		return userAgent
+	}
+	userAgent = userAgent[:maxUserAgentLength]
+	for !utf8.ValidString(userAgent) {
+		userAgent = userAgent[:len(userAgent)-1]
+	}
+	return userAgent
 }
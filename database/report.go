@@ -0,0 +1,99 @@
+package database
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// Reasons a user can give when reporting a chirp.
+const (
+	ReportReasonSpam           = "spam"
+	ReportReasonHarassment     = "harassment"
+	ReportReasonHate           = "hate"
+	ReportReasonViolence       = "violence"
+	ReportReasonMisinformation = "misinformation"
+	ReportReasonOther          = "other"
+)
+
+const (
+	ReportStatusOpen     = "open"
+	ReportStatusResolved = "resolved"
+)
+
+// Actions a moderator can take when resolving a report.
+const (
+	ReportActionDismiss = "dismiss"
+	ReportActionHide    = "hide"
+	ReportActionDelete  = "delete"
+	ReportActionWarn    = "warn"
+	ReportActionSuspend = "suspend"
+)
+
+const maxReportDetailsLength = 500
+
+// Report is a user's complaint about a chirp. It keeps a copy of the chirp so
+// the queue still shows what was reported after the chirp is edited or
+// deleted.
+type Report struct {
+	ID            int        `json:"id"`
+	ChirpID       int        `json:"chirp_id"`
+	ChirpAuthorID int        `json:"chirp_author_id"`
+	ChirpBody     string     `json:"chirp_body"`
+	ReporterID    int        `json:"reporter_id"`
+	Reason        string     `json:"reason"`
+	Details       string     `json:"details"`
+	Status        string     `json:"status"`
+	Action        string     `json:"action,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+}
+
+func NewReport(id int, chirp Chirp, reporterID int, reason, details string) (*Report, error) {
+	switch reason {
+	case ReportReasonSpam, ReportReasonHarassment, ReportReasonHate, ReportReasonViolence, ReportReasonMisinformation, ReportReasonOther:
+	default:
+		return nil, validationError("reason", "the reason %q is not one of spam, harassment, hate, violence, misinformation or other", reason)
+	}
+
+	detailsLength := utf8.RuneCountInString(details)
+	if detailsLength > maxReportDetailsLength {
+		return nil, validationError("details", "the details (len = %v) exceed the rune limit of %v", detailsLength, maxReportDetailsLength)
+	}
+
+	return &Report{
+		ID:            id,
+		ChirpID:       chirp.ID,
+		ChirpAuthorID: chirp.AuthorID,
+		ChirpBody:     chirp.Body,
+		ReporterID:    reporterID,
+		Reason:        reason,
+		Details:       details,
+		Status:        ReportStatusOpen,
+		CreatedAt:     time.Now().UTC(),
+	}, nil
+}
+
+// Resolve closes report with action.
+func (report *Report) Resolve(action string, resolvedAt time.Time) {
+	report.Status = ReportStatusResolved
+	report.Action = action
+	report.ResolvedAt = &resolvedAt
+}
+
+func validateReportAction(action string) error {
+	switch action {
+	case ReportActionDismiss, ReportActionHide, ReportActionDelete, ReportActionWarn, ReportActionSuspend:
+		return nil
+	default:
+		return validationError("action", "the action %q is not one of dismiss, hide, delete, warn or suspend", action)
+	}
+}
+
+func validateReportStatus(status string) error {
+	switch status {
+	case "", ReportStatusOpen, ReportStatusResolved:
+		return nil
+	default:
+		return validationError("status", "the status %q is not one of open or resolved", status)
+	}
+}
@@ -0,0 +1,1532 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteDB struct {
+	conn *sql.DB
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Times are always stored in UTC in the sqlite text format, so comparing
+	// them as strings orders them correctly.
+	conn, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, so serialize access instead of fighting over SQLITE_BUSY.
+	conn.SetMaxOpenConns(1)
+
+	db := SQLiteDB{
+		conn: conn,
+	}
+
+	err = db.migrate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &db, nil
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
+
+func (db *SQLiteDB) CreateUser(email, password string) (User, error) {
+	newUser, err := NewUser(0, email, password)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = db.withTx(func(tx *sql.Tx) error {
+		err := checkEmailAvailable(tx, newUser.Email, 0)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			`INSERT INTO users (email, email_normalized, password, is_chirpy_red, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			newUser.Email, NormalizeEmail(newUser.Email), newUser.Password, newUser.IsChirpyRed, newUser.CreatedAt, newUser.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		newUserID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		newUser.ID = int(newUserID)
+		newUser.Handle = defaultHandle(newUser.ID)
+
+		_, err = tx.Exec(`UPDATE users SET handle = ? WHERE id = ?`, newUser.Handle, newUser.ID)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return *newUser, nil
+}
+
+func (db *SQLiteDB) GetUserByID(userID int) (User, error) {
+	row := db.conn.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID)
+
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, notFoundError("the user with id = %v was not found", userID)
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	row := db.conn.QueryRow(`SELECT `+userColumns+` FROM users WHERE email_normalized = ?`, NormalizeEmail(email))
+
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, notFoundError("the user with email = %v was not found", email)
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) PatchUser(userID, sessionID int, patch UserPatch) (User, error) {
+	validated, err := validateUserPatch(userID, patch)
+	if err != nil {
+		return User{}, err
+	}
+
+	var patchedUser User
+	err = db.withTx(func(tx *sql.Tx) error {
+		if patch.Email != nil {
+			err := checkEmailAvailable(tx, validated.email, userID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				`UPDATE users SET email = ?, email_normalized = ?, verified = verified AND email_normalized = ? WHERE id = ?`,
+				validated.email, NormalizeEmail(validated.email), NormalizeEmail(validated.email), userID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		if patch.Password != nil {
+			_, err := tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ? AND family_id != ?`, userID, sessionID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, validated.hashedPassword, userID)
+			if err != nil {
+				return err
+			}
+		}
+		if patch.Handle != nil {
+			var ownerID int
+			err := tx.QueryRow(`SELECT id FROM users WHERE handle = ?`, validated.handle).Scan(&ownerID)
+			if err == nil && ownerID != userID {
+				return ErrHandleTaken
+			}
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE users SET handle = ? WHERE id = ?`, validated.handle, userID)
+			if err != nil {
+				return err
+			}
+		}
+		if patch.DisplayName != nil {
+			_, err := tx.Exec(`UPDATE users SET display_name = ? WHERE id = ?`, validated.displayName, userID)
+			if err != nil {
+				return err
+			}
+		}
+		if patch.Bio != nil {
+			_, err := tx.Exec(`UPDATE users SET bio = ? WHERE id = ?`, validated.bio, userID)
+			if err != nil {
+				return err
+			}
+		}
+		if patch.AvatarURL != nil {
+			_, err := tx.Exec(`UPDATE users SET avatar_url = ? WHERE id = ?`, validated.avatarURL, userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		row := tx.QueryRow(`UPDATE users SET updated_at = ? WHERE id = ? RETURNING `+userColumns, time.Now().UTC(), userID)
+		var err error
+		patchedUser, err = scanUser(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return patchedUser, nil
+}
+
+func (db *SQLiteDB) GetProfileByHandle(handle string) (Profile, error) {
+	row := db.conn.QueryRow(`SELECT `+profileColumns+` FROM users WHERE handle = ?`, NormalizeHandle(handle))
+
+	profile, err := scanProfile(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Profile{}, notFoundError("the user with handle = %v was not found", NormalizeHandle(handle))
+	}
+	return profile, err
+}
+
+func (db *SQLiteDB) GetProfiles(userIDs []int) (map[int]Profile, error) {
+	profiles := map[int]Profile{}
+	if len(userIDs) == 0 {
+		return profiles, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(userIDs)), ", ")
+	args := make([]any, len(userIDs))
+	for i, userID := range userIDs {
+		args[i] = userID
+	}
+	rows, err := db.conn.Query(`SELECT `+profileColumns+` FROM users WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		profile, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		profiles[profile.UserID] = profile
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// checkEmailAvailable returns ErrEmailTaken if a user other than userID
+// already has email.
+func checkEmailAvailable(tx *sql.Tx, email string, userID int) error {
+	var ownerID int
+	err := tx.QueryRow(`SELECT id FROM users WHERE email_normalized = ?`, NormalizeEmail(email)).Scan(&ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if ownerID != userID {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+func (db *SQLiteDB) VerifyEmail(userID int, email string) (User, error) {
+	var verifiedUser User
+	err := db.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+		if err != nil {
+			return err
+		}
+		if NormalizeEmail(user.Email) != NormalizeEmail(email) {
+			return notFoundError("the user with id = %v no longer has the email %v", userID, email)
+		}
+
+		verifiedUser = user
+		if user.Verified {
+			return nil
+		}
+		row := tx.QueryRow(`UPDATE users SET verified = 1, updated_at = ? WHERE id = ? RETURNING `+userColumns, time.Now().UTC(), userID)
+		verifiedUser, err = scanUser(row)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return verifiedUser, nil
+}
+
+func (db *SQLiteDB) UpgradeToChirpyRed(userID int) (User, error) {
+	row := db.conn.QueryRow(
+		`UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ? RETURNING `+userColumns,
+		time.Now().UTC(), userID,
+	)
+
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, notFoundError("the user with id = %v was not found", userID)
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) SetUserRoles(userID int, roles []string) (User, error) {
+	roles, err := normalizeRoles(roles)
+	if err != nil {
+		return User{}, err
+	}
+
+	row := db.conn.QueryRow(
+		`UPDATE users SET roles = ?, updated_at = ? WHERE id = ? RETURNING `+userColumns,
+		strings.Join(roles, ","), time.Now().UTC(), userID,
+	)
+
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, notFoundError("the user with id = %v was not found", userID)
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) RehashPassword(userID int, oldHash, password string) error {
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, hashedPassword, userID, oldHash)
+	return err
+}
+
+func (db *SQLiteDB) SetMFA(userID int, mfa MFA) (User, error) {
+	row := db.conn.QueryRow(
+		`UPDATE users SET totp_secret = ?, pending_totp_secret = ?, last_totp_step = ?, recovery_code_hashes = ?, updated_at = ?
+		WHERE id = ? RETURNING `+userColumns,
+		mfa.TOTPSecret, mfa.PendingTOTPSecret, mfa.LastTOTPStep, strings.Join(mfa.RecoveryCodeHashes, ","), time.Now().UTC(), userID,
+	)
+
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, notFoundError("the user with id = %v was not found", userID)
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) UseTOTPStep(userID int, step int64) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		var lastStep int64
+		err := tx.QueryRow(`SELECT last_totp_step FROM users WHERE id = ?`, userID).Scan(&lastStep)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+		if err != nil {
+			return err
+		}
+		if step <= lastStep {
+			return ErrTOTPCodeReused
+		}
+
+		_, err = tx.Exec(`UPDATE users SET last_totp_step = ? WHERE id = ?`, step, userID)
+		return err
+	})
+}
+
+func (db *SQLiteDB) UseRecoveryCode(userID int, code string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		var hashes string
+		err := tx.QueryRow(`SELECT recovery_code_hashes FROM users WHERE id = ?`, userID).Scan(&hashes)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+		if err != nil {
+			return err
+		}
+
+		var stored []string
+		if hashes != "" {
+			stored = strings.Split(hashes, ",")
+		}
+		remaining, found := removeRecoveryCode(stored, code)
+		if !found {
+			return notFoundError("the recovery code was not found")
+		}
+
+		_, err = tx.Exec(`UPDATE users SET recovery_code_hashes = ? WHERE id = ?`, strings.Join(remaining, ","), userID)
+		return err
+	})
+}
+
+func (db *SQLiteDB) CreateChirp(body string, authorID int, flagged bool) (Chirp, error) {
+	chirp, err := NewChirp(body, 0, authorID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.Flagged = flagged
+
+	result, err := db.conn.Exec(
+		`INSERT INTO chirps (body, author_id, flagged, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		chirp.Body, chirp.AuthorID, chirp.Flagged, chirp.CreatedAt, chirp.UpdatedAt,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirpID, err := result.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.ID = int(chirpID)
+
+	return *chirp, nil
+}
+
+func (db *SQLiteDB) ListChirps(query ChirpQuery) (ChirpPage, error) {
+	orderBy, err := query.orderBy()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	cursor, err := decodeChirpCursor(query.Cursor, orderBy)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	statement := `SELECT ` + chirpColumns + ` FROM chirps WHERE (? = 0 OR author_id = ?)`
+	args := []any{query.AuthorID, query.AuthorID}
+	if !query.Since.IsZero() {
+		statement += ` AND created_at >= ?`
+		args = append(args, query.Since.UTC())
+	}
+	if !query.Until.IsZero() {
+		statement += ` AND created_at < ?`
+		args = append(args, query.Until.UTC())
+	}
+	if query.FlaggedOnly {
+		statement += ` AND flagged = 1`
+	}
+	if !query.IncludeHidden {
+		statement += ` AND hidden = 0`
+	}
+
+	comparison, direction := ">", "ASC"
+	if query.Descending {
+		comparison, direction = "<", "DESC"
+	}
+	if cursor != nil {
+		if orderBy == OrderByCreatedAt {
+			statement += fmt.Sprintf(` AND (created_at %s ? OR (created_at = ? AND id %s ?))`, comparison, comparison)
+			args = append(args, cursor.CreatedAt.UTC(), cursor.CreatedAt.UTC(), cursor.ID)
+		} else {
+			statement += fmt.Sprintf(` AND id %s ?`, comparison)
+			args = append(args, cursor.ID)
+		}
+	}
+	if orderBy == OrderByCreatedAt {
+		statement += fmt.Sprintf(` ORDER BY created_at %s, id %s`, direction, direction)
+	} else {
+		statement += fmt.Sprintf(` ORDER BY id %s`, direction)
+	}
+	// Fetch one extra row to learn whether there is a next page.
+	limit := query.limit()
+	statement += ` LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := db.conn.Query(statement, args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return ChirpPage{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	page := ChirpPage{Chirps: chirps}
+	if len(chirps) > limit {
+		page.Chirps = chirps[:limit]
+		page.NextCursor = encodeChirpCursor(page.Chirps[limit-1], orderBy)
+	}
+
+	return page, nil
+}
+
+func (db *SQLiteDB) GetChirpByID(chirpID int) (Chirp, error) {
+	row := db.conn.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, chirpID)
+
+	chirp, err := scanChirp(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, notFoundError("the chirp with id = %v was not found", chirpID)
+	}
+	return chirp, err
+}
+
+func (db *SQLiteDB) EditChirp(chirpID int, body string, flagged bool) (Chirp, error) {
+	var editedChirp Chirp
+	err := db.withTx(func(tx *sql.Tx) error {
+		chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, chirpID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+		if err != nil {
+			return err
+		}
+
+		revision, err := chirp.Edit(body, flagged)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO chirp_revisions (chirp_id, body, created_at, replaced_at) VALUES (?, ?, ?, ?)`,
+			revision.ChirpID, revision.Body, revision.CreatedAt, revision.ReplacedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`UPDATE chirps SET body = ?, edited = ?, flagged = ?, updated_at = ? WHERE id = ?`,
+			chirp.Body, chirp.Edited, chirp.Flagged, chirp.UpdatedAt, chirp.ID,
+		)
+		if err != nil {
+			return err
+		}
+
+		editedChirp = chirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return editedChirp, nil
+}
+
+func (db *SQLiteDB) SetChirpFlagged(chirpID int, flagged bool) (Chirp, error) {
+	row := db.conn.QueryRow(`UPDATE chirps SET flagged = ? WHERE id = ? RETURNING `+chirpColumns, flagged, chirpID)
+
+	chirp, err := scanChirp(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, notFoundError("the chirp with id = %v was not found", chirpID)
+	}
+	return chirp, err
+}
+
+func (db *SQLiteDB) GetChirpRevisions(chirpID int) ([]ChirpRevision, error) {
+	revisions := []ChirpRevision{}
+	err := db.withTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?)`, chirpID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+
+		rows, err := tx.Query(
+			`SELECT id, chirp_id, body, created_at, replaced_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY id`,
+			chirpID,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var revision ChirpRevision
+			err := rows.Scan(&revision.ID, &revision.ChirpID, &revision.Body, &revision.CreatedAt, &revision.ReplacedAt)
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, revision)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (db *SQLiteDB) DeleteChirpByID(chirpID int) error {
+	result, err := db.conn.Exec(`DELETE FROM chirps WHERE id = ?`, chirpID)
+	if err != nil {
+		return err
+	}
+
+	if !rowsAffected(result) {
+		return notFoundError("the chirp with id = %v was not found", chirpID)
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) CreateReport(chirpID, reporterID int, reason, details string) (Report, error) {
+	var newReport Report
+	err := db.withTx(func(tx *sql.Tx) error {
+		chirp, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, chirpID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the chirp with id = %v was not found", chirpID)
+		}
+		if err != nil {
+			return err
+		}
+
+		var reported bool
+		err = tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM reports WHERE chirp_id = ? AND reporter_id = ? AND status = ?)`,
+			chirpID, reporterID, ReportStatusOpen,
+		).Scan(&reported)
+		if err != nil {
+			return err
+		}
+		if reported {
+			return conflictError("the chirp with id = %v was already reported by this user", chirpID)
+		}
+
+		report, err := NewReport(0, chirp, reporterID, reason, details)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			`INSERT INTO reports (chirp_id, chirp_author_id, chirp_body, reporter_id, reason, details, status, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			report.ChirpID, report.ChirpAuthorID, report.ChirpBody, report.ReporterID, report.Reason, report.Details, report.Status, report.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		reportID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		report.ID = int(reportID)
+
+		newReport = *report
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return newReport, nil
+}
+
+func (db *SQLiteDB) ListReports(status string) ([]Report, error) {
+	err := validateReportStatus(status)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`SELECT `+reportColumns+` FROM reports WHERE (? = '' OR status = ?) ORDER BY id`, status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+func (db *SQLiteDB) ResolveReport(reportID int, action string) (Report, error) {
+	err := validateReportAction(action)
+	if err != nil {
+		return Report{}, err
+	}
+
+	var resolvedReport Report
+	err = db.withTx(func(tx *sql.Tx) error {
+		report, err := scanReport(tx.QueryRow(`SELECT `+reportColumns+` FROM reports WHERE id = ?`, reportID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the report with id = %v was not found", reportID)
+		}
+		if err != nil {
+			return err
+		}
+		if report.Status != ReportStatusOpen {
+			return conflictError("the report with id = %v is already resolved", reportID)
+		}
+
+		now := time.Now().UTC()
+		var result sql.Result
+		switch action {
+		case ReportActionHide:
+			result, err = tx.Exec(`UPDATE chirps SET hidden = 1 WHERE id = ?`, report.ChirpID)
+		case ReportActionDelete:
+			result, err = tx.Exec(`DELETE FROM chirps WHERE id = ?`, report.ChirpID)
+		case ReportActionWarn:
+			result, err = tx.Exec(`UPDATE users SET warnings = warnings + 1, updated_at = ? WHERE id = ?`, now, report.ChirpAuthorID)
+		case ReportActionSuspend:
+			result, err = tx.Exec(`UPDATE users SET suspended = 1, updated_at = ? WHERE id = ?`, now, report.ChirpAuthorID)
+		}
+		if err != nil {
+			return err
+		}
+		if result != nil && !rowsAffected(result) {
+			if action == ReportActionWarn || action == ReportActionSuspend {
+				return notFoundError("the user with id = %v was not found", report.ChirpAuthorID)
+			}
+			return notFoundError("the chirp with id = %v was not found", report.ChirpID)
+		}
+
+		_, err = tx.Exec(
+			`UPDATE reports SET status = ?, action = ?, resolved_at = ? WHERE chirp_id = ? AND status = ?`,
+			ReportStatusResolved, action, now, report.ChirpID, ReportStatusOpen,
+		)
+		if err != nil {
+			return err
+		}
+
+		report.Resolve(action, now)
+		resolvedReport = report
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return resolvedReport, nil
+}
+
+func (db *SQLiteDB) CreateRefreshToken(userID int, userAgent, ip string) (RefreshToken, error) {
+	refreshToken, err := NewRefreshToken(userID, 0, time.Time{}, userAgent, ip)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	err = db.withTx(func(tx *sql.Tx) error {
+		newID, err := insertRefreshToken(tx, *refreshToken)
+		if err != nil {
+			return err
+		}
+		refreshToken.ID = newID
+		refreshToken.FamilyID = newID
+
+		_, err = tx.Exec(`UPDATE refresh_tokens SET family_id = id WHERE id = ?`, newID)
+		return err
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return *refreshToken, nil
+}
+
+func (db *SQLiteDB) RotateRefreshToken(refreshToken, userAgent, ip string) (RefreshToken, error) {
+	var newRefToken RefreshToken
+	reused := false
+	err := db.withTx(func(tx *sql.Tx) error {
+		row := tx.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, hashToken(refreshToken))
+		storedRefToken, err := scanRefreshToken(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFoundError("the refresh token was not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if storedRefToken.RotatedAt != nil {
+			// The family is revoked even though the refresh fails, so the
+			// deletion has to be committed.
+			reused = true
+			_, err := tx.Exec(`DELETE FROM refresh_tokens WHERE family_id = ?`, storedRefToken.FamilyID)
+			return err
+		}
+		if !now.Before(storedRefToken.ExpiresAt) {
+			return notFoundError("the refresh token has expired")
+		}
+
+		_, err = tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE id = ?`, now, storedRefToken.ID)
+		if err != nil {
+			return err
+		}
+
+		nextRefToken, err := NewRefreshToken(storedRefToken.UserID, storedRefToken.FamilyID, storedRefToken.CreatedAt, userAgent, ip)
+		if err != nil {
+			return err
+		}
+
+		nextRefToken.ID, err = insertRefreshToken(tx, *nextRefToken)
+		if err != nil {
+			return err
+		}
+
+		newRefToken = *nextRefToken
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+
+	return newRefToken, nil
+}
+
+func (db *SQLiteDB) GetRefreshTokenInfo(refreshToken string) (RefreshToken, error) {
+	row := db.conn.QueryRow(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, hashToken(refreshToken))
+
+	storedRefToken, err := scanRefreshToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, notFoundError("the refresh token was not found")
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return storedRefToken, nil
+}
+
+func (db *SQLiteDB) DeleteRefreshTokenFamily(familyID int) error {
+	result, err := db.conn.Exec(`DELETE FROM refresh_tokens WHERE family_id = ?`, familyID)
+	if err != nil {
+		return err
+	}
+
+	if !rowsAffected(result) {
+		return notFoundError("the refresh token family with id = %v was not found", familyID)
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) DeleteExpiredRefreshTokens() (int, error) {
+	result, err := db.conn.Exec(`DELETE FROM refresh_tokens WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func (db *SQLiteDB) ListSessions(userID int) ([]Session, error) {
+	rows, err := db.conn.Query(`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE user_id = ? AND rotated_at IS NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	sessions := []Session{}
+	for rows.Next() {
+		refreshToken, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		if refreshToken.isLive(now) {
+			sessions = append(sessions, refreshToken.session())
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (db *SQLiteDB) GetSession(userID, sessionID int) (Session, error) {
+	row := db.conn.QueryRow(
+		`SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE family_id = ? AND user_id = ? AND rotated_at IS NULL`,
+		sessionID, userID,
+	)
+
+	refreshToken, err := scanRefreshToken(row)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !refreshToken.isLive(time.Now().UTC())) {
+		return Session{}, notFoundError("the session with id = %v was not found", sessionID)
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	return refreshToken.session(), nil
+}
+
+func (db *SQLiteDB) DeleteSession(userID, sessionID int) error {
+	result, err := db.conn.Exec(`DELETE FROM refresh_tokens WHERE family_id = ? AND user_id = ?`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	if !rowsAffected(result) {
+		return notFoundError("the session with id = %v was not found", sessionID)
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) DeleteUserSessions(userID int) (int, error) {
+	revoked := 0
+	err := db.withTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT COUNT(DISTINCT family_id) FROM refresh_tokens WHERE user_id = ?`, userID).Scan(&revoked)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE user_id = ?`, userID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revoked, nil
+}
+
+func (db *SQLiteDB) CreatePasswordResetToken(userID int) (PasswordResetToken, error) {
+	resetToken, err := NewPasswordResetToken(userID)
+	if err != nil {
+		return PasswordResetToken{}, err
+	}
+
+	err = db.withTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return notFoundError("the user with id = %v was not found", userID)
+		}
+
+		_, err = tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec(
+			`INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, created_at) VALUES (?, ?, ?, ?)`,
+			resetToken.UserID, resetToken.TokenHash, resetToken.ExpiresAt, resetToken.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+
+		newID, err := result.LastInsertId()
+		resetToken.ID = int(newID)
+		return err
+	})
+	if err != nil {
+		return PasswordResetToken{}, err
+	}
+
+	return *resetToken, nil
+}
+
+func (db *SQLiteDB) ResetPassword(token, password string) (User, error) {
+	err := validatePassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	var updatedUser User
+	err = db.withTx(func(tx *sql.Tx) error {
+		var userID int
+		var expiresAt time.Time
+		err := tx.QueryRow(`SELECT user_id, expires_at FROM password_reset_tokens WHERE token_hash = ?`, hashToken(token)).Scan(&userID, &expiresAt)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !time.Now().UTC().Before(expiresAt)) {
+			return notFoundError("the password reset token was not found or has expired")
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		_, err = tx.Exec(`UPDATE users SET password = ?, updated_at = ? WHERE id = ?`, hashedPassword, now, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range []string{
+			`DELETE FROM password_reset_tokens WHERE user_id = ?`,
+			`DELETE FROM refresh_tokens WHERE user_id = ?`,
+		} {
+			_, err := tx.Exec(statement, userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		row := tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID)
+		updatedUser, err = scanUser(row)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return updatedUser, nil
+}
+
+func (db *SQLiteDB) DeleteExpiredPasswordResetTokens() (int, error) {
+	result, err := db.conn.Exec(`DELETE FROM password_reset_tokens WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+func insertRefreshToken(tx *sql.Tx, refreshToken RefreshToken) (int, error) {
+	result, err := tx.Exec(
+		`INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at, created_at, last_used_at, user_agent, ip)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		refreshToken.FamilyID, refreshToken.UserID, refreshToken.TokenHash, refreshToken.ExpiresAt,
+		refreshToken.CreatedAt, refreshToken.LastUsedAt, refreshToken.UserAgent, refreshToken.IP,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	newID, err := result.LastInsertId()
+	return int(newID), err
+}
+
+// sqliteMigrations is applied in order; the index of the last applied entry
+// (plus one) is kept in PRAGMA user_version.
+var sqliteMigrations = []struct {
+	description string
+	up          func(tx *sql.Tx) error
+}{
+	{
+		description: "create users, chirps and refresh_tokens tables",
+		up: execStatements(
+			`CREATE TABLE users (
+				id            INTEGER PRIMARY KEY AUTOINCREMENT,
+				email         TEXT NOT NULL,
+				password      TEXT NOT NULL,
+				is_chirpy_red INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX users_email ON users (email)`,
+			`CREATE TABLE chirps (
+				id        INTEGER PRIMARY KEY AUTOINCREMENT,
+				body      TEXT NOT NULL,
+				author_id INTEGER NOT NULL
+			)`,
+			`CREATE INDEX chirps_author_id ON chirps (author_id)`,
+			`CREATE TABLE refresh_tokens (
+				user_id    INTEGER PRIMARY KEY,
+				token      TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL
+			)`,
+		),
+	},
+	{
+		description: "add a unique users.email_normalized column",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`ALTER TABLE users ADD COLUMN email_normalized TEXT`)
+			if err != nil {
+				return err
+			}
+
+			rows, err := tx.Query(`SELECT id, email FROM users ORDER BY id`)
+			if err != nil {
+				return err
+			}
+			normalizedByID := map[int]string{}
+			seen := map[string]bool{}
+			for rows.Next() {
+				var id int
+				var email string
+				err := rows.Scan(&id, &email)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				// Older duplicates keep the email; later ones are left NULL
+				// and can no longer be found by email.
+				normalized := NormalizeEmail(email)
+				if !seen[normalized] {
+					seen[normalized] = true
+					normalizedByID[id] = normalized
+				}
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			for id, normalized := range normalizedByID {
+				_, err := tx.Exec(`UPDATE users SET email_normalized = ? WHERE id = ?`, normalized, id)
+				if err != nil {
+					return err
+				}
+			}
+
+			return execStatements(
+				`CREATE UNIQUE INDEX users_email_normalized ON users (email_normalized)`,
+				`DROP INDEX users_email`,
+			)(tx)
+		},
+	},
+	{
+		description: "add created_at and updated_at to chirps and users",
+		up: func(tx *sql.Tx) error {
+			err := execStatements(
+				`ALTER TABLE users ADD COLUMN created_at DATETIME`,
+				`ALTER TABLE users ADD COLUMN updated_at DATETIME`,
+				`ALTER TABLE chirps ADD COLUMN created_at DATETIME`,
+				`ALTER TABLE chirps ADD COLUMN updated_at DATETIME`,
+			)(tx)
+			if err != nil {
+				return err
+			}
+
+			// Bind the backfill time so it is written in the same format as
+			// new rows and compares correctly against them.
+			now := time.Now().UTC()
+			for _, table := range []string{"users", "chirps"} {
+				_, err := tx.Exec(`UPDATE `+table+` SET created_at = ?, updated_at = ?`, now, now)
+				if err != nil {
+					return err
+				}
+			}
+
+			return execStatements(
+				`CREATE INDEX chirps_created_at ON chirps (created_at, id)`,
+				`CREATE INDEX chirps_author_id_created_at ON chirps (author_id, created_at, id)`,
+			)(tx)
+		},
+	},
+	{
+		description: "add chirps.edited and the chirp_revisions table",
+		up: execStatements(
+			`ALTER TABLE chirps ADD COLUMN edited INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE chirp_revisions (
+				id          INTEGER PRIMARY KEY AUTOINCREMENT,
+				chirp_id    INTEGER NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+				body        TEXT NOT NULL,
+				created_at  DATETIME NOT NULL,
+				replaced_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX chirp_revisions_chirp_id ON chirp_revisions (chirp_id, id)`,
+		),
+	},
+	{
+		description: "add chirps.flagged",
+		up: execStatements(
+			`ALTER TABLE chirps ADD COLUMN flagged INTEGER NOT NULL DEFAULT 0`,
+			`CREATE INDEX chirps_flagged ON chirps (id) WHERE flagged = 1`,
+		),
+	},
+	{
+		description: "add the reports table, chirps.hidden, users.suspended and users.warnings",
+		up: execStatements(
+			`CREATE TABLE reports (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				chirp_id        INTEGER NOT NULL,
+				chirp_author_id INTEGER NOT NULL,
+				chirp_body      TEXT NOT NULL,
+				reporter_id     INTEGER NOT NULL,
+				reason          TEXT NOT NULL,
+				details         TEXT NOT NULL,
+				status          TEXT NOT NULL,
+				action          TEXT NOT NULL DEFAULT '',
+				created_at      DATETIME NOT NULL,
+				resolved_at     DATETIME
+			)`,
+			`CREATE INDEX reports_chirp_id ON reports (chirp_id, status)`,
+			`CREATE INDEX reports_status ON reports (status, id)`,
+			`ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN warnings INTEGER NOT NULL DEFAULT 0`,
+		),
+	},
+	{
+		description: "add users.roles",
+		// Roles are stored comma-separated; they are validated names that
+		// never contain a comma.
+		up: execStatements(
+			`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		description: "key refresh_tokens by id and group them into families",
+		up: execStatements(
+			`CREATE TABLE refresh_tokens_new (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				family_id  INTEGER NOT NULL,
+				user_id    INTEGER NOT NULL,
+				token      TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL,
+				rotated_at DATETIME
+			)`,
+			`INSERT INTO refresh_tokens_new (family_id, user_id, token, expires_at)
+				SELECT 0, user_id, token, expires_at FROM refresh_tokens ORDER BY user_id`,
+			`UPDATE refresh_tokens_new SET family_id = id`,
+			`DROP TABLE refresh_tokens`,
+			`ALTER TABLE refresh_tokens_new RENAME TO refresh_tokens`,
+			`CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id)`,
+		),
+	},
+	{
+		description: "record the client and times of refresh_tokens",
+		up: func(tx *sql.Tx) error {
+			err := execStatements(
+				`ALTER TABLE refresh_tokens ADD COLUMN created_at DATETIME`,
+				`ALTER TABLE refresh_tokens ADD COLUMN last_used_at DATETIME`,
+				`ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT ''`,
+				`CREATE INDEX refresh_tokens_user_id ON refresh_tokens (user_id)`,
+			)(tx)
+			if err != nil {
+				return err
+			}
+			return backfillRefreshTokenTimes(tx)
+		},
+	},
+	{
+		description: "store refresh tokens as SHA-256 hashes",
+		up: func(tx *sql.Tx) error {
+			err := hashRefreshTokens(tx)
+			if err != nil {
+				return err
+			}
+			return execStatements(
+				`ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash`,
+				`CREATE INDEX refresh_tokens_expires_at ON refresh_tokens (expires_at)`,
+			)(tx)
+		},
+	},
+	{
+		description: "create password_reset_tokens table",
+		up: execStatements(
+			`CREATE TABLE password_reset_tokens (
+				id         INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id    INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL,
+				created_at DATETIME NOT NULL
+			)`,
+			`CREATE INDEX password_reset_tokens_user_id ON password_reset_tokens (user_id)`,
+		),
+	},
+	{
+		description: "add users.verified",
+		// Accounts created before verification existed are trusted.
+		up: execStatements(
+			`ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE users SET verified = 1`,
+		),
+	},
+	{
+		description: "add the two-factor authentication columns of users",
+		up: execStatements(
+			`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN pending_totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN last_totp_step INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE users ADD COLUMN recovery_code_hashes TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		description: "add the profile columns of users",
+		// Existing users get the handles new users get, which nobody else can
+		// take.
+		up: execStatements(
+			`ALTER TABLE users ADD COLUMN handle TEXT`,
+			`ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT ''`,
+			`UPDATE users SET handle = '`+defaultHandlePrefix+`' || id`,
+			`CREATE UNIQUE INDEX users_handle ON users (handle)`,
+		),
+	},
+}
+
+// hashRefreshTokens replaces the plaintext tokens with their hashes, which
+// SQLite cannot compute itself.
+func hashRefreshTokens(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, token FROM refresh_tokens`)
+	if err != nil {
+		return err
+	}
+
+	tokens := map[int]string{}
+	for rows.Next() {
+		var id int
+		var token string
+		err := rows.Scan(&id, &token)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for id, token := range tokens {
+		_, err := tx.Exec(`UPDATE refresh_tokens SET token = ? WHERE id = ?`, hashToken(token), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillRefreshTokenTimes fills created_at and last_used_at of existing
+// tokens. A token was issued refreshTokenLifetime before it expires, and its
+// family was started when the oldest token still kept was issued.
+func backfillRefreshTokenTimes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, family_id, expires_at FROM refresh_tokens`)
+	if err != nil {
+		return err
+	}
+
+	issuedAt := map[int]time.Time{}
+	familyIDs := map[int]int{}
+	familyCreatedAt := map[int]time.Time{}
+	for rows.Next() {
+		var id, familyID int
+		var expiresAt time.Time
+		err := rows.Scan(&id, &familyID, &expiresAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		issuedAt[id] = expiresAt.Add(-refreshTokenLifetime)
+		familyIDs[id] = familyID
+		if createdAt, seen := familyCreatedAt[familyID]; !seen || issuedAt[id].Before(createdAt) {
+			familyCreatedAt[familyID] = issuedAt[id]
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for id, lastUsedAt := range issuedAt {
+		_, err := tx.Exec(
+			`UPDATE refresh_tokens SET created_at = ?, last_used_at = ? WHERE id = ?`,
+			familyCreatedAt[familyIDs[id]], lastUsedAt, id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) migrate() error {
+	var version int
+	err := db.conn.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		err = sqliteMigrations[i].up(tx)
+		if err == nil {
+			// PRAGMA does not accept bound parameters.
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d (%s): %w", i+1, sqliteMigrations[i].description, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func planSQLiteMigrations(path string) (MigrationReport, error) {
+	report := MigrationReport{
+		Path:      path,
+		ToVersion: len(sqliteMigrations),
+	}
+
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		report.FromVersion = report.ToVersion
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	conn, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return report, err
+	}
+	defer conn.Close()
+
+	err = conn.QueryRow(`PRAGMA user_version`).Scan(&report.FromVersion)
+	if err != nil {
+		return report, err
+	}
+
+	for i := report.FromVersion; i < len(sqliteMigrations); i++ {
+		report.Steps = append(report.Steps, MigrationStep{
+			Version:     i + 1,
+			Description: sqliteMigrations[i].description,
+		})
+	}
+
+	return report, nil
+}
+
+func (db *SQLiteDB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func execStatements(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			_, err := tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// userColumns, profileColumns, chirpColumns, reportColumns and
+// refreshTokenColumns are the columns read by scanUser, scanProfile,
+// scanChirp, scanReport and scanRefreshToken, in order.
+const (
+	userColumns         = `id, email, password, is_chirpy_red, verified, suspended, warnings, roles, created_at, updated_at, totp_secret, pending_totp_secret, last_totp_step, recovery_code_hashes, handle, display_name, bio, avatar_url`
+	profileColumns      = `id, handle, display_name, bio, avatar_url, created_at, (SELECT COUNT(*) FROM chirps WHERE author_id = users.id AND hidden = 0)`
+	chirpColumns        = `id, body, author_id, edited, flagged, hidden, created_at, updated_at`
+	reportColumns       = `id, chirp_id, chirp_author_id, chirp_body, reporter_id, reason, details, status, action, created_at, resolved_at`
+	refreshTokenColumns = `id, family_id, user_id, token_hash, expires_at, rotated_at, created_at, last_used_at, user_agent, ip`
+)
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var roles, recoveryCodeHashes string
+	err := row.Scan(
+		&user.ID, &user.Email, &user.Password, &user.IsChirpyRed, &user.Verified, &user.Suspended, &user.Warnings, &roles, &user.CreatedAt, &user.UpdatedAt,
+		&user.MFA.TOTPSecret, &user.MFA.PendingTOTPSecret, &user.MFA.LastTOTPStep, &recoveryCodeHashes,
+		&user.Handle, &user.DisplayName, &user.Bio, &user.AvatarURL,
+	)
+	user.Roles = []string{}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if recoveryCodeHashes != "" {
+		user.MFA.RecoveryCodeHashes = strings.Split(recoveryCodeHashes, ",")
+	}
+	return user, err
+}
+
+func scanProfile(row rowScanner) (Profile, error) {
+	var profile Profile
+	err := row.Scan(&profile.UserID, &profile.Handle, &profile.DisplayName, &profile.Bio, &profile.AvatarURL, &profile.CreatedAt, &profile.ChirpCount)
+	return profile, err
+}
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	var chirp Chirp
+	err := row.Scan(&chirp.ID, &chirp.Body, &chirp.AuthorID, &chirp.Edited, &chirp.Flagged, &chirp.Hidden, &chirp.CreatedAt, &chirp.UpdatedAt)
+	return chirp, err
+}
+
+func scanReport(row rowScanner) (Report, error) {
+	var report Report
+	var resolvedAt sql.NullTime
+	err := row.Scan(
+		&report.ID, &report.ChirpID, &report.ChirpAuthorID, &report.ChirpBody, &report.ReporterID,
+		&report.Reason, &report.Details, &report.Status, &report.Action, &report.CreatedAt, &resolvedAt,
+	)
+	if resolvedAt.Valid {
+		report.ResolvedAt = &resolvedAt.Time
+	}
+	return report, err
+}
+
+func scanRefreshToken(row rowScanner) (RefreshToken, error) {
+	var refreshToken RefreshToken
+	var rotatedAt sql.NullTime
+	err := row.Scan(
+		&refreshToken.ID, &refreshToken.FamilyID, &refreshToken.UserID, &refreshToken.TokenHash, &refreshToken.ExpiresAt, &rotatedAt,
+		&refreshToken.CreatedAt, &refreshToken.LastUsedAt, &refreshToken.UserAgent, &refreshToken.IP,
+	)
+	if rotatedAt.Valid {
+		refreshToken.RotatedAt = &rotatedAt.Time
+	}
+	return refreshToken, err
+}
+
+func rowsAffected(result sql.Result) bool {
+	affected, err := result.RowsAffected()
+	return err == nil && affected > 0
+}
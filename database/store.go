@@ -0,0 +1,172 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Store is the storage backend used by the HTTP handlers. DB (a single JSON
+// file) and SQLiteDB both implement it.
+type Store interface {
+	CreateUser(email, password string) (User, error)
+	GetUserByID(userID int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	// PatchUser changes the fields of a user set in patch and keeps the rest.
+	// Changing the email clears Verified; changing the password revokes every
+	// session of the user except sessionID.
+	PatchUser(userID, sessionID int, patch UserPatch) (User, error)
+	// GetProfileByHandle returns the public profile of the user with handle,
+	// compared by its normalized form.
+	GetProfileByHandle(handle string) (Profile, error)
+	// GetProfiles returns the public profiles of those of userIDs that exist,
+	// keyed by user ID.
+	GetProfiles(userIDs []int) (map[int]Profile, error)
+	UpgradeToChirpyRed(userID int) (User, error)
+	// VerifyEmail marks the email of a user as verified, as long as it is
+	// still email.
+	VerifyEmail(userID int, email string) (User, error)
+	// SetUserRoles replaces the roles of a user.
+	SetUserRoles(userID int, roles []string) (User, error)
+	// RehashPassword replaces the password hash of a user, made with outdated
+	// settings, with one made with the current settings. password must have
+	// been checked against oldHash; if the password was changed since, nothing
+	// happens.
+	RehashPassword(userID int, oldHash, password string) error
+	// SetMFA replaces the two-factor authentication state of a user.
+	SetMFA(userID int, mfa MFA) (User, error)
+	// UseTOTPStep records that a user entered the code of a TOTP time step.
+	// It returns ErrTOTPCodeReused unless step is later than the last one.
+	UseTOTPStep(userID int, step int64) error
+	// UseRecoveryCode uses up one of the recovery codes of a user.
+	UseRecoveryCode(userID int, code string) error
+
+	// CreateChirp and EditChirp store a body that has already been moderated;
+	// flagged marks it for review.
+	CreateChirp(body string, authorID int, flagged bool) (Chirp, error)
+	ListChirps(query ChirpQuery) (ChirpPage, error)
+	GetChirpByID(chirpID int) (Chirp, error)
+	// EditChirp replaces the body of a chirp, keeping the old body as a
+	// revision.
+	EditChirp(chirpID int, body string, flagged bool) (Chirp, error)
+	// SetChirpFlagged flags a chirp for review or clears the flag.
+	SetChirpFlagged(chirpID int, flagged bool) (Chirp, error)
+	// GetChirpRevisions returns the previous bodies of a chirp, oldest first.
+	GetChirpRevisions(chirpID int) ([]ChirpRevision, error)
+	DeleteChirpByID(chirpID int) error
+
+	// CreateReport files a report against a chirp; a user can have one open
+	// report per chirp.
+	CreateReport(chirpID, reporterID int, reason, details string) (Report, error)
+	// ListReports returns the reports with status, or every report if status
+	// is empty, oldest first.
+	ListReports(status string) ([]Report, error)
+	// ResolveReport applies action to the reported chirp or its author and
+	// resolves every open report of that chirp.
+	ResolveReport(reportID int, action string) (Report, error)
+
+	// CreateRefreshToken starts a new token family for a login from the
+	// client described by userAgent and ip.
+	CreateRefreshToken(userID int, userAgent, ip string) (RefreshToken, error)
+	// RotateRefreshToken exchanges an unused, unexpired refresh token for the
+	// next token of its family. Presenting a token that was already exchanged
+	// revokes the whole family and returns ErrRefreshTokenReused.
+	RotateRefreshToken(refreshToken, userAgent, ip string) (RefreshToken, error)
+	GetRefreshTokenInfo(refreshToken string) (RefreshToken, error)
+	// DeleteRefreshTokenFamily revokes every token of a family.
+	DeleteRefreshTokenFamily(familyID int) error
+	// DeleteExpiredRefreshTokens removes the refresh tokens that have expired
+	// and returns how many there were.
+	DeleteExpiredRefreshTokens() (int, error)
+
+	// ListSessions returns the sessions of a user that can still be
+	// refreshed, most recently used first.
+	ListSessions(userID int) ([]Session, error)
+	// GetSession returns a session of a user that can still be refreshed.
+	GetSession(userID, sessionID int) (Session, error)
+	// DeleteSession revokes a session of a user.
+	DeleteSession(userID, sessionID int) error
+	// DeleteUserSessions revokes every session of a user and returns how
+	// many were revoked.
+	DeleteUserSessions(userID int) (int, error)
+
+	// CreatePasswordResetToken issues a reset token for a user, replacing
+	// any token issued before.
+	CreatePasswordResetToken(userID int) (PasswordResetToken, error)
+	// ResetPassword sets the password of the user of an unexpired reset
+	// token, uses the token up and revokes every session of the user.
+	ResetPassword(token, password string) (User, error)
+	// DeleteExpiredPasswordResetTokens removes the reset tokens that have
+	// expired and returns how many there were.
+	DeleteExpiredPasswordResetTokens() (int, error)
+
+	Close() error
+}
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+type Config struct {
+	Driver string
+	Path   string
+	// WAL and WALCompactEvery only apply to the JSON driver.
+	WAL             bool
+	WALCompactEvery int
+}
+
+// DefaultPath returns the database location used when CHIRPY_DB_PATH is not set.
+func DefaultPath(driver string) string {
+	if driver == DriverSQLite {
+		return "database.db"
+	}
+	return "database.json"
+}
+
+// PlanMigrations reports the migrations Open would apply to the configured
+// database without modifying it.
+func PlanMigrations(cfg Config) (MigrationReport, error) {
+	switch cfg.Driver {
+	case "", DriverJSON:
+		return planJSONMigrations(cfg.Path)
+	case DriverSQLite:
+		return planSQLiteMigrations(cfg.Path)
+	default:
+		return MigrationReport{}, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
+
+// Remove deletes the configured database together with the files that go
+// with it: the operation log of the JSON driver, or the journal and
+// write-ahead log SQLite keeps next to its database.
+func Remove(cfg Config) error {
+	var paths []string
+	switch cfg.Driver {
+	case "", DriverJSON:
+		paths = []string{cfg.Path, cfg.Path + walSuffix}
+	case DriverSQLite:
+		paths = []string{cfg.Path, cfg.Path + "-journal", cfg.Path + "-wal", cfg.Path + "-shm"}
+	default:
+		return fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func Open(cfg Config) (Store, error) {
+	switch cfg.Driver {
+	case "", DriverJSON:
+		return NewDBWithOptions(cfg.Path, Options{WAL: cfg.WAL, CompactEvery: cfg.WALCompactEvery})
+	case DriverSQLite:
+		return NewSQLiteDB(cfg.Path)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
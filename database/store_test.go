@@ -0,0 +1,201 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testStores are the configurations the Store tests run against.
+var testStores = []struct {
+	name   string
+	config Config
+}{
+	{"json", Config{Driver: DriverJSON, Path: "database.json"}},
+	{"json+wal", Config{Driver: DriverJSON, Path: "database.json", WAL: true, WALCompactEvery: 3}},
+	{"sqlite", Config{Driver: DriverSQLite, Path: "database.db"}},
+}
+
+// forEachStore runs test against a new, empty database of every driver.
+func forEachStore(t *testing.T, test func(t *testing.T, db Store)) {
+	for _, store := range testStores {
+		t.Run(store.name, func(t *testing.T) {
+			config := store.config
+			config.Path = filepath.Join(t.TempDir(), config.Path)
+			db, err := Open(config)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer db.Close()
+
+			test(t, db)
+		})
+	}
+}
+
+func createTestUser(t *testing.T, db Store) User {
+	t.Helper()
+	user, err := db.CreateUser("alice@example.com", "correct horse")
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	return user
+}
+
+// TestRefreshTokenReuse revokes the whole family of a refresh token that is
+// presented a second time, and leaves the other sessions of the user alone.
+func TestRefreshTokenReuse(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user := createTestUser(t, db)
+
+		first, err := db.CreateRefreshToken(user.ID, "test", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("CreateRefreshToken: %v", err)
+		}
+		other, err := db.CreateRefreshToken(user.ID, "test", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("CreateRefreshToken: %v", err)
+		}
+
+		second, err := db.RotateRefreshToken(first.Token, "test", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("RotateRefreshToken: %v", err)
+		}
+		if second.FamilyID != first.FamilyID || second.Token == first.Token {
+			t.Fatalf("rotating gave %+v, want a new token of family %d", second, first.FamilyID)
+		}
+
+		_, err = db.RotateRefreshToken(first.Token, "test", "127.0.0.1")
+		if !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("reusing the first token: got %v, want ErrRefreshTokenReused", err)
+		}
+
+		tests := []struct {
+			name      string
+			token     string
+			wantValid bool
+		}{
+			{"reused token", first.Token, false},
+			{"token issued after it", second.Token, false},
+			{"token of another session", other.Token, true},
+		}
+		for _, test := range tests {
+			_, err := db.GetRefreshTokenInfo(test.token)
+			if (err == nil) != test.wantValid {
+				t.Errorf("%s: GetRefreshTokenInfo: %v, want valid %v", test.name, err, test.wantValid)
+			}
+		}
+
+		if _, err := db.RotateRefreshToken(second.Token, "test", "127.0.0.1"); err == nil {
+			t.Errorf("the revoked family could still be refreshed")
+		}
+		if _, err := db.RotateRefreshToken(other.Token, "test", "127.0.0.1"); err != nil {
+			t.Errorf("refreshing another session: %v", err)
+		}
+	})
+}
+
+// TestUseTOTPStep accepts each time step once, and none older than the last
+// one used.
+func TestUseTOTPStep(t *testing.T) {
+	forEachStore(t, func(t *testing.T, db Store) {
+		user := createTestUser(t, db)
+
+		tests := []struct {
+			step    int64
+			wantErr error
+		}{
+			{100, nil},
+			{100, ErrTOTPCodeReused},
+			{99, ErrTOTPCodeReused},
+			{101, nil},
+		}
+		for _, test := range tests {
+			err := db.UseTOTPStep(user.ID, test.step)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("UseTOTPStep(%d) = %v, want %v", test.step, err, test.wantErr)
+			}
+		}
+	})
+}
+
+// TestListChirpsCursor pages through chirps while others are created and
+// deleted: a cursor keeps its place, so no chirp is returned twice or
+// skipped.
+func TestListChirpsCursor(t *testing.T) {
+	tests := []struct {
+		orderBy    string
+		descending bool
+		// deleteSeen is on the first page, deleteUnseen after it.
+		deleteSeen   int
+		deleteUnseen int
+		want         []int
+	}{
+		{OrderByID, false, 2, 5, []int{1, 2, 3, 4, 6, 7, 8, 9, 10, 11}},
+		{OrderByID, true, 9, 5, []int{10, 9, 8, 7, 6, 4, 3, 2, 1}},
+		{OrderByCreatedAt, false, 2, 5, []int{1, 2, 3, 4, 6, 7, 8, 9, 10, 11}},
+		{OrderByCreatedAt, true, 9, 5, []int{10, 9, 8, 7, 6, 4, 3, 2, 1}},
+	}
+	forEachStore(t, func(t *testing.T, db Store) {
+		for _, test := range tests {
+			user, err := db.CreateUser(fmt.Sprintf("%s-%v@example.com", test.orderBy, test.descending), "correct horse")
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			// ids maps the position of a chirp in creation order, from 1, to
+			// its ID.
+			ids := []int{0}
+			for i := 1; i <= 10; i++ {
+				chirp, err := db.CreateChirp(fmt.Sprintf("chirp %d", i), user.ID, false)
+				if err != nil {
+					t.Fatalf("CreateChirp: %v", err)
+				}
+				ids = append(ids, chirp.ID)
+			}
+
+			query := ChirpQuery{AuthorID: user.ID, OrderBy: test.orderBy, Descending: test.descending, Limit: 3}
+			var got []int
+			for page := 0; ; page++ {
+				if page > len(test.want) {
+					t.Fatalf("%s descending=%v: the pages do not end", test.orderBy, test.descending)
+				}
+				result, err := db.ListChirps(query)
+				if err != nil {
+					t.Fatalf("ListChirps: %v", err)
+				}
+				for _, chirp := range result.Chirps {
+					for position, id := range ids {
+						if id == chirp.ID {
+							got = append(got, position)
+						}
+					}
+				}
+
+				if page == 0 {
+					for _, position := range []int{test.deleteSeen, test.deleteUnseen} {
+						err := db.DeleteChirpByID(ids[position])
+						if err != nil {
+							t.Fatalf("DeleteChirpByID: %v", err)
+						}
+					}
+					chirp, err := db.CreateChirp("chirp 11", user.ID, false)
+					if err != nil {
+						t.Fatalf("CreateChirp: %v", err)
+					}
+					ids = append(ids, chirp.ID)
+				}
+
+				if result.NextCursor == "" {
+					break
+				}
+				query.Cursor = result.NextCursor
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s descending=%v: got chirps %v, want %v", test.orderBy, test.descending, got, test.want)
+			}
+		}
+	})
+}
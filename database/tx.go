@@ -0,0 +1,430 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var errReadOnlyTx = errors.New("cannot write in a read-only transaction")
+
+// Tx is a view of the database inside View or Update. Writes made through an
+// Update transaction are persisted together when the callback returns nil
+// and discarded otherwise.
+type Tx struct {
+	data     *DBStructure
+	index    *dbIndex
+	ops      []walOp
+	writable bool
+}
+
+// View runs fn with a consistent snapshot of the database.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	db.mux.RLock()
+	for db.cache == nil {
+		db.mux.RUnlock()
+		db.mux.Lock()
+		err := db.ensureLoadedLocked()
+		db.mux.Unlock()
+		if err != nil {
+			return err
+		}
+		db.mux.RLock()
+	}
+	defer db.mux.RUnlock()
+
+	return fn(&Tx{data: db.cache, index: &db.index})
+}
+
+// Update runs fn while holding the write lock, so no other writer can load the
+// database between fn reading it and its changes being persisted.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err := db.ensureLoadedLocked()
+	if err != nil {
+		return err
+	}
+
+	tx := &Tx{data: db.cache, index: &db.index, writable: true}
+	err = fn(tx)
+	if err == nil && len(tx.ops) > 0 {
+		err = db.commitLocked(*db.cache, tx.ops)
+	}
+	if err != nil {
+		// fn works on the cache directly, so throw away whatever it changed.
+		if len(tx.ops) > 0 {
+			db.invalidateLocked()
+		}
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	state, err := db.statFiles()
+	if err != nil {
+		db.invalidateLocked()
+		return nil
+	}
+	db.fileState = state
+	return nil
+}
+
+func (tx *Tx) nextID(sequence string) (int, error) {
+	if !tx.writable {
+		return 0, errReadOnlyTx
+	}
+
+	tx.data.Sequences[sequence]++
+	id := tx.data.Sequences[sequence]
+	tx.ops = append(tx.ops, putOp("sequences", sequence, id))
+	return id, nil
+}
+
+func (tx *Tx) User(userID int) (User, bool) {
+	user, exists := tx.data.Users[userID]
+	return user, exists
+}
+
+// UserByEmail looks email up by its normalized form.
+func (tx *Tx) UserByEmail(email string) (User, bool) {
+	userID, exists := tx.index.userIDByEmail[NormalizeEmail(email)]
+	if !exists {
+		return User{}, false
+	}
+	return tx.User(userID)
+}
+
+// UserByHandle looks handle up by its normalized form.
+func (tx *Tx) UserByHandle(handle string) (User, bool) {
+	userID, exists := tx.index.userIDByHandle[NormalizeHandle(handle)]
+	if !exists {
+		return User{}, false
+	}
+	return tx.User(userID)
+}
+
+func (tx *Tx) Users() []User {
+	users := make([]User, 0, len(tx.data.Users))
+	for _, user := range tx.data.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// NextUserID reserves an ID that has never been used by any user, including
+// deleted ones.
+func (tx *Tx) NextUserID() (int, error) {
+	return tx.nextID("users")
+}
+
+func (tx *Tx) PutUser(user User) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldUser, exists := tx.data.Users[user.ID]; exists {
+		tx.index.removeUser(oldUser)
+	}
+	tx.data.Users[user.ID] = user
+	tx.index.addUser(user)
+	tx.ops = append(tx.ops, putOp("users", user.ID, user))
+	return nil
+}
+
+func (tx *Tx) Chirp(chirpID int) (Chirp, bool) {
+	chirp, exists := tx.data.Chirps[chirpID]
+	return chirp, exists
+}
+
+// Chirps returns every chirp ordered by ID.
+func (tx *Tx) Chirps() []Chirp {
+	return tx.chirpsByIDs(tx.index.chirpIDs[OrderByID][0])
+}
+
+// ChirpsByAuthor returns the chirps of one author ordered by ID.
+func (tx *Tx) ChirpsByAuthor(authorID int) []Chirp {
+	if authorID == 0 {
+		return []Chirp{}
+	}
+	return tx.chirpsByIDs(tx.index.chirpIDs[OrderByID][authorID])
+}
+
+// VisibleChirpCount counts the chirps of an author that are not hidden.
+func (tx *Tx) VisibleChirpCount(authorID int) int {
+	if authorID == 0 {
+		return 0
+	}
+	count := 0
+	for _, chirpID := range tx.index.chirpIDs[OrderByID][authorID] {
+		if !tx.data.Chirps[chirpID].Hidden {
+			count++
+		}
+	}
+	return count
+}
+
+func (tx *Tx) chirpsByIDs(chirpIDs []int) []Chirp {
+	chirps := make([]Chirp, 0, len(chirpIDs))
+	for _, chirpID := range chirpIDs {
+		chirps = append(chirps, tx.data.Chirps[chirpID])
+	}
+	return chirps
+}
+
+// NextChirpID reserves an ID that has never been used by any chirp, including
+// deleted ones.
+func (tx *Tx) NextChirpID() (int, error) {
+	return tx.nextID("chirps")
+}
+
+func (tx *Tx) PutChirp(chirp Chirp) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldChirp, exists := tx.data.Chirps[chirp.ID]; exists {
+		tx.index.removeChirp(tx.data.Chirps, oldChirp)
+	}
+	tx.data.Chirps[chirp.ID] = chirp
+	tx.index.addChirp(tx.data.Chirps, chirp)
+	tx.ops = append(tx.ops, putOp("chirps", chirp.ID, chirp))
+	return nil
+}
+
+func (tx *Tx) DeleteChirp(chirpID int) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldChirp, exists := tx.data.Chirps[chirpID]; exists {
+		tx.index.removeChirp(tx.data.Chirps, oldChirp)
+	}
+	delete(tx.data.Chirps, chirpID)
+	tx.ops = append(tx.ops, deleteOp("chirps", chirpID))
+	return nil
+}
+
+// ChirpRevisions returns the revisions of one chirp ordered by ID, which is
+// also the order they were made in.
+func (tx *Tx) ChirpRevisions(chirpID int) []ChirpRevision {
+	revisionIDs := tx.index.revisionIDsByChirp[chirpID]
+	revisions := make([]ChirpRevision, 0, len(revisionIDs))
+	for _, revisionID := range revisionIDs {
+		revisions = append(revisions, tx.data.ChirpRevisions[revisionID])
+	}
+	return revisions
+}
+
+func (tx *Tx) NextChirpRevisionID() (int, error) {
+	return tx.nextID("chirp_revisions")
+}
+
+func (tx *Tx) PutChirpRevision(revision ChirpRevision) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldRevision, exists := tx.data.ChirpRevisions[revision.ID]; exists {
+		tx.index.removeChirpRevision(oldRevision)
+	}
+	tx.data.ChirpRevisions[revision.ID] = revision
+	tx.index.addChirpRevision(revision)
+	tx.ops = append(tx.ops, putOp("chirp_revisions", revision.ID, revision))
+	return nil
+}
+
+func (tx *Tx) DeleteChirpRevision(revisionID int) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldRevision, exists := tx.data.ChirpRevisions[revisionID]; exists {
+		tx.index.removeChirpRevision(oldRevision)
+	}
+	delete(tx.data.ChirpRevisions, revisionID)
+	tx.ops = append(tx.ops, deleteOp("chirp_revisions", revisionID))
+	return nil
+}
+
+func (tx *Tx) Report(reportID int) (Report, bool) {
+	report, exists := tx.data.Reports[reportID]
+	return report, exists
+}
+
+// Reports returns every report ordered by ID.
+func (tx *Tx) Reports() []Report {
+	reportIDs := make([]int, 0, len(tx.data.Reports))
+	for reportID := range tx.data.Reports {
+		reportIDs = append(reportIDs, reportID)
+	}
+	sort.Ints(reportIDs)
+
+	reports := make([]Report, 0, len(reportIDs))
+	for _, reportID := range reportIDs {
+		reports = append(reports, tx.data.Reports[reportID])
+	}
+	return reports
+}
+
+// ReportsByChirp returns the reports of one chirp ordered by ID.
+func (tx *Tx) ReportsByChirp(chirpID int) []Report {
+	reportIDs := tx.index.reportIDsByChirp[chirpID]
+	reports := make([]Report, 0, len(reportIDs))
+	for _, reportID := range reportIDs {
+		reports = append(reports, tx.data.Reports[reportID])
+	}
+	return reports
+}
+
+func (tx *Tx) NextReportID() (int, error) {
+	return tx.nextID("reports")
+}
+
+func (tx *Tx) PutReport(report Report) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldReport, exists := tx.data.Reports[report.ID]; exists {
+		tx.index.reportIDsByChirp[oldReport.ChirpID] = removeID(tx.index.reportIDsByChirp[oldReport.ChirpID], oldReport.ID)
+	}
+	tx.data.Reports[report.ID] = report
+	tx.index.reportIDsByChirp[report.ChirpID] = insertID(tx.index.reportIDsByChirp[report.ChirpID], report.ID)
+	tx.ops = append(tx.ops, putOp("reports", report.ID, report))
+	return nil
+}
+
+func (tx *Tx) RefreshTokenByHash(tokenHash string) (RefreshToken, bool) {
+	tokenID, exists := tx.index.refreshTokenIDByHash[tokenHash]
+	if !exists {
+		return RefreshToken{}, false
+	}
+	refreshToken, exists := tx.data.RefreshTokens[tokenID]
+	return refreshToken, exists
+}
+
+// RefreshTokensByFamily returns the tokens of a family, oldest first.
+func (tx *Tx) RefreshTokensByFamily(familyID int) []RefreshToken {
+	tokenIDs := tx.index.refreshTokenIDsByFamily[familyID]
+	refreshTokens := make([]RefreshToken, 0, len(tokenIDs))
+	for _, tokenID := range tokenIDs {
+		refreshTokens = append(refreshTokens, tx.data.RefreshTokens[tokenID])
+	}
+	return refreshTokens
+}
+
+// RefreshTokenFamilies returns the IDs of the token families of a user in
+// ascending order.
+func (tx *Tx) RefreshTokenFamilies(userID int) []int {
+	familyIDs := tx.index.familyIDsByUser[userID]
+	return append([]int{}, familyIDs...)
+}
+
+// ExpiredRefreshTokens returns the tokens that expired before now.
+func (tx *Tx) ExpiredRefreshTokens(now time.Time) []RefreshToken {
+	refreshTokens := []RefreshToken{}
+	for _, refreshToken := range tx.data.RefreshTokens {
+		if !now.Before(refreshToken.ExpiresAt) {
+			refreshTokens = append(refreshTokens, refreshToken)
+		}
+	}
+	return refreshTokens
+}
+
+func (tx *Tx) NextRefreshTokenID() (int, error) {
+	return tx.nextID("refresh_tokens")
+}
+
+func (tx *Tx) PutRefreshToken(refreshToken RefreshToken) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldRefToken, exists := tx.data.RefreshTokens[refreshToken.ID]; exists {
+		tx.index.removeRefreshToken(oldRefToken)
+	}
+	tx.data.RefreshTokens[refreshToken.ID] = refreshToken
+	tx.index.addRefreshToken(refreshToken)
+	tx.ops = append(tx.ops, putOp("refresh_tokens", refreshToken.ID, refreshToken))
+	return nil
+}
+
+func (tx *Tx) DeleteRefreshToken(tokenID int) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldRefToken, exists := tx.data.RefreshTokens[tokenID]; exists {
+		tx.index.removeRefreshToken(oldRefToken)
+	}
+	delete(tx.data.RefreshTokens, tokenID)
+	tx.ops = append(tx.ops, deleteOp("refresh_tokens", tokenID))
+	return nil
+}
+
+func (tx *Tx) PasswordResetTokenByHash(tokenHash string) (PasswordResetToken, bool) {
+	tokenID, exists := tx.index.passwordResetTokenIDByHash[tokenHash]
+	if !exists {
+		return PasswordResetToken{}, false
+	}
+	resetToken, exists := tx.data.PasswordResetTokens[tokenID]
+	return resetToken, exists
+}
+
+// PasswordResetTokensByUser returns the reset tokens of a user. There are
+// few, so they are not indexed by user.
+func (tx *Tx) PasswordResetTokensByUser(userID int) []PasswordResetToken {
+	resetTokens := []PasswordResetToken{}
+	for _, resetToken := range tx.data.PasswordResetTokens {
+		if resetToken.UserID == userID {
+			resetTokens = append(resetTokens, resetToken)
+		}
+	}
+	return resetTokens
+}
+
+// ExpiredPasswordResetTokens returns the reset tokens that expired before
+// now.
+func (tx *Tx) ExpiredPasswordResetTokens(now time.Time) []PasswordResetToken {
+	resetTokens := []PasswordResetToken{}
+	for _, resetToken := range tx.data.PasswordResetTokens {
+		if !now.Before(resetToken.ExpiresAt) {
+			resetTokens = append(resetTokens, resetToken)
+		}
+	}
+	return resetTokens
+}
+
+func (tx *Tx) NextPasswordResetTokenID() (int, error) {
+	return tx.nextID("password_reset_tokens")
+}
+
+func (tx *Tx) PutPasswordResetToken(resetToken PasswordResetToken) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldResetToken, exists := tx.data.PasswordResetTokens[resetToken.ID]; exists {
+		delete(tx.index.passwordResetTokenIDByHash, oldResetToken.TokenHash)
+	}
+	tx.data.PasswordResetTokens[resetToken.ID] = resetToken
+	tx.index.passwordResetTokenIDByHash[resetToken.TokenHash] = resetToken.ID
+	tx.ops = append(tx.ops, putOp("password_reset_tokens", resetToken.ID, resetToken))
+	return nil
+}
+
+func (tx *Tx) DeletePasswordResetToken(tokenID int) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+
+	if oldResetToken, exists := tx.data.PasswordResetTokens[tokenID]; exists {
+		delete(tx.index.passwordResetTokenIDByHash, oldResetToken.TokenHash)
+	}
+	delete(tx.data.PasswordResetTokens, tokenID)
+	tx.ops = append(tx.ops, deleteOp("password_reset_tokens", tokenID))
+	return nil
+}
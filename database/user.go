@@ -2,44 +2,127 @@ package database
 
 import (
 	"errors"
+	"sort"
+	"time"
+)
 
-	"golang.org/x/crypto/bcrypt"
+const (
+	// RoleAdmin can manage users, roles and the moderation rules.
+	RoleAdmin = "admin"
+	// RoleModerator can review reports and flagged chirps.
+	RoleModerator = "moderator"
 )
 
 type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	ID          int       `json:"id"`
+	Email       string    `json:"email"`
+	Password    string    `json:"password"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Suspended   bool      `json:"suspended"`
+	Warnings    int       `json:"warnings"`
+	Roles       []string  `json:"roles"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// Verified is set once the user has shown they own Email. Changing the
+	// email clears it.
+	Verified bool `json:"verified"`
+	// MFA only changes through SetMFA, UseTOTPStep and UseRecoveryCode.
+	MFA MFA `json:"mfa"`
+
+	// Handle is unique and stored normalized. It, DisplayName, Bio and
+	// AvatarURL make up the public Profile of the user.
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// UserPatch lists the fields of a user to change; nil fields are kept.
+type UserPatch struct {
+	Email       *string
+	Password    *string
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
 }
 
 func NewUser(id int, email, password string) (*User, error) {
+	email, err := validateEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validatePassword(password)
+	if err != nil {
+		return nil, err
+	}
+
 	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now().UTC()
 	newUser := User{
 		ID:          id,
 		Email:       email,
 		Password:    hashedPassword,
 		IsChirpyRed: false,
+		Roles:       []string{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 	return &newUser, nil
 }
 
-func hashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", errors.New("error hashing the password")
-	}
-	return string(hashedPassword), nil
-}
-
 func (user *User) ComparePassword(password string) error {
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	if err != nil {
+	if !comparePasswordHash(user.Password, password) {
 		return errors.New("incorrect password")
 	}
 	return nil
 }
+
+// PasswordNeedsRehash reports whether the password hash of the user was made
+// with other settings than the current ones. Once the password was checked,
+// RehashPassword upgrades it.
+func (user *User) PasswordNeedsRehash() bool {
+	return passwordHashOutdated(user.Password)
+}
+
+// CompareDummyPassword takes as long as ComparePassword, so a login with an
+// unknown email cannot be told apart from one with a wrong password by its
+// timing.
+func CompareDummyPassword(password string) {
+	comparePasswordHash(dummyPasswordHash, password)
+}
+
+// HasRole reports whether the user has at least one of roles.
+func (user *User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		for _, userRole := range user.Roles {
+			if userRole == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeRoles validates roles and returns them sorted, without duplicates.
+func normalizeRoles(roles []string) ([]string, error) {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, role := range roles {
+		if role != RoleAdmin && role != RoleModerator {
+			return nil, validationError("roles", "the role %q is not one of admin or moderator", role)
+		}
+		if !seen[role] {
+			seen[role] = true
+			normalized = append(normalized, role)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
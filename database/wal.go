@@ -0,0 +1,222 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Romasav/chirpy/atomicfile"
+)
+
+// The operation log is an optional append-only file next to the snapshot
+// (database.json.wal). Each line is one committed transaction; readLocked
+// replays the lines over the snapshot and compact folds them back into it.
+
+const defaultCompactEvery = 1000
+
+// walSuffix is appended to the snapshot path to name the operation log.
+const walSuffix = ".wal"
+
+type walOp struct {
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Value      any    `json:"value,omitempty"`
+}
+
+type walRecord struct {
+	Ops []walOp `json:"ops"`
+}
+
+type walReplayRecord struct {
+	Ops []struct {
+		Op         string          `json:"op"`
+		Collection string          `json:"collection"`
+		Key        string          `json:"key"`
+		Value      json.RawMessage `json:"value"`
+	} `json:"ops"`
+}
+
+func putOp(collection string, key any, value any) walOp {
+	return walOp{Op: "put", Collection: collection, Key: fmt.Sprint(key), Value: value}
+}
+
+func deleteOp(collection string, key any) walOp {
+	return walOp{Op: "delete", Collection: collection, Key: fmt.Sprint(key)}
+}
+
+// commitLocked persists a mutation of dbStructure described by ops, either by
+// appending the ops to the log or by rewriting the snapshot. The caller must
+// hold the write lock.
+func (db *DB) commitLocked(dbStructure DBStructure, ops []walOp) error {
+	if !db.wal {
+		return db.writeSnapshotLocked(dbStructure)
+	}
+
+	line, err := json.Marshal(walRecord{Ops: ops})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	file, err := os.OpenFile(db.walPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err == nil {
+		_, err = file.Write(line)
+		if err != nil {
+			// Drop the partial line so the next record does not get appended to it.
+			file.Truncate(info.Size())
+		}
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	db.walRecords++
+	if db.walRecords >= db.compactEvery {
+		err = db.writeSnapshotLocked(dbStructure)
+		if err != nil {
+			return err
+		}
+		return db.removeLogLocked()
+	}
+	return nil
+}
+
+// compact folds the operation log into the snapshot and removes the log.
+func (db *DB) compact() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.compactLocked()
+}
+
+func (db *DB) compactLocked() error {
+	data, err := db.readSnapshotLocked()
+	if err != nil {
+		return err
+	}
+
+	err = atomicfile.WriteFile(db.path, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return db.removeLogLocked()
+}
+
+func (db *DB) removeLogLocked() error {
+	err := os.Remove(db.walPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	db.walRecords = 0
+
+	return nil
+}
+
+func (db *DB) walPath() string {
+	return db.path + walSuffix
+}
+
+// readSnapshotLocked returns the snapshot with the operation log applied.
+func (db *DB) readSnapshotLocked() ([]byte, error) {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := os.ReadFile(db.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return replayLog(data, log)
+}
+
+// replayLog applies the records in log to the snapshot. It works on raw JSON
+// so it is independent of the current struct definitions, and a torn final
+// line left by a crash mid-append is ignored.
+func replayLog(snapshot, log []byte) ([]byte, error) {
+	doc := map[string]json.RawMessage{}
+	err := json.Unmarshal(snapshot, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	collections := map[string]map[string]json.RawMessage{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		var record walReplayRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			if isLastLine(log, lineNumber) {
+				break
+			}
+			return nil, fmt.Errorf("operation log line %d is corrupt: %w", lineNumber, err)
+		}
+
+		for _, op := range record.Ops {
+			collection, loaded := collections[op.Collection]
+			if !loaded {
+				collection = map[string]json.RawMessage{}
+				if raw, exists := doc[op.Collection]; exists && string(raw) != "null" {
+					err := json.Unmarshal(raw, &collection)
+					if err != nil {
+						return nil, err
+					}
+				}
+				collections[op.Collection] = collection
+			}
+
+			switch op.Op {
+			case "put":
+				collection[op.Key] = op.Value
+			case "delete":
+				delete(collection, op.Key)
+			default:
+				return nil, fmt.Errorf("operation log line %d has unknown op %q", lineNumber, op.Op)
+			}
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, collection := range collections {
+		raw, err := json.Marshal(collection)
+		if err != nil {
+			return nil, err
+		}
+		doc[name] = raw
+	}
+
+	return json.Marshal(doc)
+}
+
+func isLastLine(log []byte, lineNumber int) bool {
+	return bytes.Count(bytes.TrimRight(log, "\n"), []byte("\n"))+1 == lineNumber
+}
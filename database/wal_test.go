@@ -0,0 +1,128 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReplayLog(t *testing.T) {
+	const snapshot = `{"chirps":{"1":"one","2":"two"}}`
+
+	tests := []struct {
+		name    string
+		log     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "put and delete",
+			log: `{"ops":[{"op":"put","collection":"chirps","key":"3","value":"three"}]}` + "\n" +
+				`{"ops":[{"op":"delete","collection":"chirps","key":"1"}]}` + "\n",
+			want: map[string]string{"2": "two", "3": "three"},
+		},
+		{
+			name: "torn last line",
+			log: `{"ops":[{"op":"put","collection":"chirps","key":"3","value":"three"}]}` + "\n" +
+				`{"ops":[{"op":"put","collection":"chi`,
+			want: map[string]string{"1": "one", "2": "two", "3": "three"},
+		},
+		{
+			name: "torn last line with a newline",
+			log:  `{"ops":[{"op":"delete","coll` + "\n",
+			want: map[string]string{"1": "one", "2": "two"},
+		},
+		{
+			name: "corrupt line before the last",
+			log: `{"ops":[{"op":"put","collection":"chi` + "\n" +
+				`{"ops":[{"op":"delete","collection":"chirps","key":"1"}]}` + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown op",
+			log:     `{"ops":[{"op":"patch","collection":"chirps","key":"1","value":"uno"}]}` + "\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := replayLog([]byte(snapshot), []byte(test.log))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("replayLog error %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+
+			var doc struct {
+				Chirps map[string]string `json:"chirps"`
+			}
+			err = json.Unmarshal(data, &doc)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(doc.Chirps, test.want) {
+				t.Errorf("replayLog = %v, want %v", doc.Chirps, test.want)
+			}
+		})
+	}
+}
+
+// TestTornLogTail reopens a database whose operation log ends in a line cut
+// off by a crash: the committed records are kept, and writing goes on.
+func TestTornLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{WAL: true, CompactEvery: 100}
+
+	db, err := NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatalf("NewDBWithOptions: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := db.CreateChirp("before the crash", 1, false)
+		if err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+	}
+	db.Close()
+
+	file, err := os.OpenFile(path+walSuffix, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("opening the log: %v", err)
+	}
+	_, err = file.WriteString(`{"ops":[{"op":"put","collection":"chirps","key":"4","val`)
+	if err != nil {
+		t.Fatalf("tearing the log: %v", err)
+	}
+	file.Close()
+
+	for _, want := range []int{3, 4} {
+		db, err := NewDBWithOptions(path, options)
+		if err != nil {
+			t.Fatalf("reopening: %v", err)
+		}
+
+		var chirps []Chirp
+		err = db.View(func(tx *Tx) error {
+			chirps = tx.Chirps()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+		if len(chirps) != want {
+			t.Errorf("the database holds %d chirps, want %d", len(chirps), want)
+		}
+
+		chirp, err := db.CreateChirp("after the crash", 1, false)
+		if err != nil {
+			t.Fatalf("CreateChirp: %v", err)
+		}
+		if chirp.ID != want+1 {
+			t.Errorf("the new chirp got the ID %d, want %d", chirp.ID, want+1)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/keyset"
+	"github.com/Romasav/chirpy/mailer"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const emailVerificationLifetime = 24 * time.Hour
+
+// emailVerificationClaims name the user and the address being verified, so a
+// link stops working once the user changes their email.
+type emailVerificationClaims struct {
+	jwt.RegisteredClaims
+	Email string `json:"email"`
+}
+
+// emailVerifier sends the links users follow to verify their email address.
+type emailVerifier struct {
+	keys *keyset.Keyset
+	mail mailer.Mailer
+	// baseURL is where the server is reachable, such as
+	// https://chirpy.example.com.
+	baseURL string
+	// guard limits the links sent on request, per user and per client IP.
+	guard *loginGuard
+}
+
+// reserve counts a link about to be sent to user at the request of r. If the
+// user or the client asked for too many, it responds with an error and
+// returns false instead.
+func (verifier *emailVerifier) reserve(w http.ResponseWriter, r *http.Request, user database.User) bool {
+	wait := verifier.guard.reserve(strconv.Itoa(user.ID), clientIP(r))
+	if wait > 0 {
+		respondWithThrottled(w, wait, "Too many verification emails, try again later")
+		return false
+	}
+	return true
+}
+
+// send emails a verification link for the current address of user. Sending
+// happens in the background; failures are only logged.
+func (verifier *emailVerifier) send(user database.User) {
+	token, err := verifier.keys.Sign(&emailVerificationClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   strconv.Itoa(user.ID),
+			Audience:  jwt.ClaimStrings{emailVerificationAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(emailVerificationLifetime)),
+		},
+		Email: user.Email,
+	})
+	if err != nil {
+		log.Printf("Could not sign the verification token of user %d: %v", user.ID, err)
+		return
+	}
+
+	link := verifier.baseURL + "/api/users/verify?" + url.Values{"token": {token}}.Encode()
+	message := mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf(
+			"Open this link within 24 hours to confirm that this is your email address:\n\n"+
+				"%s\n\n"+
+				"If you did not sign up for Chirpy, ignore this email.\n",
+			link,
+		),
+	}
+
+	go func() {
+		err := verifier.mail.Send(message)
+		if err != nil {
+			log.Printf("Could not send the verification email to user %d: %v", user.ID, err)
+		}
+	}()
+}
+
+// parseEmailVerificationToken validates a token from a verification link and
+// returns the user and email it verifies.
+func parseEmailVerificationToken(tokenStr string, keys *keyset.Keyset) (int, string, error) {
+	claims := &emailVerificationClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keys.Keyfunc,
+		jwt.WithValidMethods(keyset.Algorithms),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(emailVerificationAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(accessTokenLeeway),
+	)
+	if err != nil || !token.Valid {
+		return 0, "", errInvalidToken
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.Email == "" {
+		return 0, "", errInvalidToken
+	}
+
+	return userID, claims.Email, nil
+}
+
+func handlerVerifyEmail(w http.ResponseWriter, r *http.Request, db database.Store, keys *keyset.Keyset) {
+	userID, email, err := parseEmailVerificationToken(r.URL.Query().Get("token"), keys)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "The verification link is invalid or has expired")
+		return
+	}
+
+	user, err := db.VerifyEmail(userID, email)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "The verification link is invalid or has expired")
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, err, "Failed to verify email")
+		return
+	}
+
+	respond := struct {
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+	}{
+		Email:    user.Email,
+		Verified: user.Verified,
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
+
+// handlerResendVerification sends a new verification link to the logged-in
+// user, for when the first one was lost or has expired.
+func handlerResendVerification(w http.ResponseWriter, r *http.Request, db database.Store, verifier *emailVerifier) {
+	user, err := db.GetUserByID(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if user.Verified {
+		respondWithError(w, http.StatusConflict, "The email address is already verified")
+		return
+	}
+	if !verifier.reserve(w, r, user) {
+		return
+	}
+
+	verifier.send(user)
+	respondWithJSON(w, struct{}{}, http.StatusAccepted)
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/keyset"
+	"github.com/Romasav/chirpy/moderation"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -20,10 +24,15 @@ func handlerReadiness(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
-func handlerGetChirp(w http.ResponseWriter, r *http.Request, db *database.DB) {
-	chirps, err := db.GetChirps()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to load chirps")
+func handlerGetChirp(w http.ResponseWriter, r *http.Request, db database.Store) {
+	moderator := isModeratorRequest(r, db)
+	query := database.ChirpQuery{
+		Cursor:        r.URL.Query().Get("cursor"),
+		IncludeHidden: moderator,
+	}
+
+	expandAuthor, ok := parseExpandAuthor(w, r)
+	if !ok {
 		return
 	}
 
@@ -31,81 +40,201 @@ func handlerGetChirp(w http.ResponseWriter, r *http.Request, db *database.DB) {
 	if authorIDString != "" {
 		authorID, err := strconv.Atoi(authorIDString)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Couldnt get authorId")
+			respondWithError(w, http.StatusBadRequest, "Invalid author_id")
 			return
 		}
-		filteredChirps := []database.Chirp{}
-		for _, chirp := range chirps {
-			if chirp.AuthorID == authorID {
-				filteredChirps = append(filteredChirps, chirp)
-			}
+		query.AuthorID = authorID
+	}
+
+	limitString := r.URL.Query().Get("limit")
+	if limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > database.MaxChirpPageSize {
+			errorMessage := fmt.Sprintf("limit must be between 1 and %d", database.MaxChirpPageSize)
+			respondWithError(w, http.StatusBadRequest, errorMessage)
+			return
 		}
-		chirps = filteredChirps
+		query.Limit = limit
 	}
 
 	sortMethod := r.URL.Query().Get("sort")
 	if sortMethod == "" {
 		sortMethod = "asc"
 	}
-	if sortMethod == "asc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID < chirps[j].ID
-		})
-	} else if sortMethod == "desc" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID > chirps[j].ID
-		})
+	if sortMethod != "asc" && sortMethod != "desc" {
+		respondWithError(w, http.StatusBadRequest, "sort must be asc or desc")
+		return
+	}
+	query.Descending = sortMethod == "desc"
+
+	sortBy := r.URL.Query().Get("sort_by")
+	if sortBy == "" {
+		sortBy = database.OrderByID
+	}
+	if sortBy != database.OrderByID && sortBy != database.OrderByCreatedAt {
+		respondWithError(w, http.StatusBadRequest, "sort_by must be id or created_at")
+		return
+	}
+	query.OrderBy = sortBy
+
+	sinceString := r.URL.Query().Get("since")
+	if sinceString != "" {
+		since, err := time.Parse(time.RFC3339, sinceString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+		query.Since = since
+	}
+
+	untilString := r.URL.Query().Get("until")
+	if untilString != "" {
+		until, err := time.Parse(time.RFC3339, untilString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "until must be an RFC 3339 timestamp")
+			return
+		}
+		query.Until = until
+	}
+
+	page, err := db.ListChirps(query)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load chirps")
+		return
+	}
+
+	if page.NextCursor != "" {
+		nextQuery := r.URL.Query()
+		nextQuery.Set("cursor", page.NextCursor)
+		nextURL := url.URL{Path: r.URL.Path, RawQuery: nextQuery.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.String()))
+	}
+
+	chirps := newChirpResponses(page.Chirps, moderator)
+	if expandAuthor {
+		err := withAuthors(db, chirps)
+		if err != nil {
+			respondWithDBError(w, err, "Failed to load authors")
+			return
+		}
 	}
 
 	respondWithJSON(w, chirps, http.StatusOK)
 }
 
-func handlerGetChirpByID(w http.ResponseWriter, r *http.Request, db *database.DB) {
+func handlerGetChirpByID(w http.ResponseWriter, r *http.Request, db database.Store) {
 	chirpIDStr := r.PathValue("chirpID")
 	chirpID, err := strconv.Atoi(chirpIDStr)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to convert chirpIDStr to int")
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+
+	expandAuthor, ok := parseExpandAuthor(w, r)
+	if !ok {
 		return
 	}
 
 	chirp, err := db.GetChirpByID(chirpID)
 	if err != nil {
-		errorMessage := fmt.Sprintf("The chirp with id = %v was not found", chirpID)
-		respondWithError(w, http.StatusNotFound, errorMessage)
+		respondWithDBError(w, err, "Failed to load chirp")
+		return
+	}
+
+	moderator := isModeratorRequest(r, db)
+	if chirp.Hidden && !moderator {
+		respondWithHiddenChirp(w, chirpID)
 		return
 	}
 
-	respondWithJSON(w, chirp, http.StatusOK)
+	chirps := []chirpResponse{newChirpResponse(chirp, moderator)}
+	if expandAuthor {
+		err := withAuthors(db, chirps)
+		if err != nil {
+			respondWithDBError(w, err, "Failed to load author")
+			return
+		}
+	}
+
+	respondWithJSON(w, chirps[0], http.StatusOK)
 }
 
-func handlerPostChirp(w http.ResponseWriter, r *http.Request, db *database.DB) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
+func handlerPostChirp(w http.ResponseWriter, r *http.Request, db database.Store, moderator *moderation.Engine) {
+	userId := requestUserID(r)
+
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Body string `json:"body"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
 
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	user, err := db.GetUserByID(userId)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Your account is suspended")
+		return
+	}
+
+	moderated := moderator.Check(request.Body)
+	if moderated.Rejected {
+		respondWithError(w, http.StatusUnprocessableEntity, "The chirp contains words that are not allowed")
+		return
+	}
+
+	chirp, err := db.CreateChirp(moderated.Body, userId, moderated.Flagged)
+	if err != nil {
+		respondWithDBError(w, err, "Could not create chirp")
+		return
+	}
+
+	respondWithJSON(w, newChirpResponse(chirp, user.HasRole(database.RoleAdmin, database.RoleModerator)), http.StatusCreated)
+}
+
+func handlerDeleteChirp(w http.ResponseWriter, r *http.Request, db database.Store) {
+	userId := requestUserID(r)
+
+	chirpIDStr := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+
+	chirp, err := db.GetChirpByID(chirpID)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load chirp")
+		return
+	}
 
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		jwtSecret := os.Getenv("JWT_SECRET")
-		return []byte(jwtSecret), nil
-	})
-	if err != nil || !token.Valid {
-		respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+	if chirp.AuthorID != userId {
+		respondWithError(w, http.StatusForbidden, "you cant delete chirps that were created by someone else")
 		return
 	}
 
-	claims := token.Claims
-	userIdString, err := claims.GetSubject()
+	err = db.DeleteChirpByID(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token claims")
+		respondWithDBError(w, err, "Failed to delete chirp")
 		return
 	}
 
-	userId, err := strconv.Atoi(userIdString)
+	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+}
+
+func handlerPutChirp(w http.ResponseWriter, r *http.Request, db database.Store, moderator *moderation.Engine) {
+	userId := requestUserID(r)
+
+	chirpIDStr := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDStr)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldnt get userId")
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
 		return
 	}
 
@@ -119,75 +248,72 @@ func handlerPostChirp(w http.ResponseWriter, r *http.Request, db *database.DB) {
 		return
 	}
 
-	chirp, err := db.CreateChirp(request.Body, userId)
+	chirp, err := db.GetChirpByID(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Could not create chirp")
+		respondWithDBError(w, err, "Failed to load chirp")
 		return
 	}
 
-	respondWithJSON(w, chirp, http.StatusCreated)
-}
-
-func handlerDeleteChirp(w http.ResponseWriter, r *http.Request, db *database.DB) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
+	if chirp.AuthorID != userId {
+		respondWithError(w, http.StatusForbidden, "you cant edit chirps that were created by someone else")
 		return
 	}
 
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	user, err := db.GetUserByID(userId)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
 
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		jwtSecret := os.Getenv("JWT_SECRET")
-		return []byte(jwtSecret), nil
-	})
-	if err != nil || !token.Valid {
-		respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+	if user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Your account is suspended")
 		return
 	}
 
-	claims := token.Claims
-	userIdString, err := claims.GetSubject()
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token claims")
+	moderated := moderator.Check(request.Body)
+	if moderated.Rejected {
+		respondWithError(w, http.StatusUnprocessableEntity, "The chirp contains words that are not allowed")
 		return
 	}
 
-	userId, err := strconv.Atoi(userIdString)
+	editedChirp, err := db.EditChirp(chirpID, moderated.Body, moderated.Flagged)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldnt get userId")
+		respondWithDBError(w, err, "Failed to edit chirp")
 		return
 	}
 
+	respondWithJSON(w, newChirpResponse(editedChirp, user.HasRole(database.RoleAdmin, database.RoleModerator)), http.StatusOK)
+}
+
+func handlerGetChirpRevisions(w http.ResponseWriter, r *http.Request, db database.Store) {
 	chirpIDStr := r.PathValue("chirpID")
 	chirpID, err := strconv.Atoi(chirpIDStr)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to convert chirpIDStr to int")
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
 		return
 	}
 
 	chirp, err := db.GetChirpByID(chirpID)
 	if err != nil {
-		errorMessage := fmt.Sprintf("The chirp with id = %v was not found", chirpID)
-		respondWithError(w, http.StatusNotFound, errorMessage)
+		respondWithDBError(w, err, "Failed to load chirp")
 		return
 	}
 
-	if chirp.AuthorID != userId {
-		respondWithError(w, http.StatusForbidden, "you cant delete chirps that were created by someone else")
+	if chirp.Hidden && !isModeratorRequest(r, db) {
+		respondWithHiddenChirp(w, chirpID)
 		return
 	}
 
-	err = db.DeleteChirpByID(chirpID)
+	revisions, err := db.GetChirpRevisions(chirpID)
 	if err != nil {
-		respondWithError(w, http.StatusForbidden, "error deleting a chirp")
+		respondWithDBError(w, err, "Failed to load chirp revisions")
 		return
 	}
 
-	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+	respondWithJSON(w, revisions, http.StatusOK)
 }
 
-func handlerPostUser(w http.ResponseWriter, r *http.Request, db *database.DB) {
+func handlerPostUser(w http.ResponseWriter, r *http.Request, db database.Store, verifier *emailVerifier) {
 	decoder := json.NewDecoder(r.Body)
 	request := struct {
 		Email    string `json:"email"`
@@ -201,24 +327,38 @@ func handlerPostUser(w http.ResponseWriter, r *http.Request, db *database.DB) {
 
 	user, err := db.CreateUser(request.Email, request.Password)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldnt create user")
+		respondWithDBError(w, err, "Couldnt create user")
 		return
 	}
 
+	verifier.send(user)
+
 	userRespond := struct {
-		ID          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		ID          int       `json:"id"`
+		Email       string    `json:"email"`
+		Handle      string    `json:"handle"`
+		IsChirpyRed bool      `json:"is_chirpy_red"`
+		Verified    bool      `json:"verified"`
+		Roles       []string  `json:"roles"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
 	}{
 		ID:          user.ID,
 		Email:       user.Email,
+		Handle:      user.Handle,
 		IsChirpyRed: user.IsChirpyRed,
+		Verified:    user.Verified,
+		Roles:       user.Roles,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
 	}
 
 	respondWithJSON(w, userRespond, http.StatusCreated)
 }
 
-func handlerLoginUser(w http.ResponseWriter, r *http.Request, db *database.DB) {
+// handlerLoginUser answers every wrong email or password the same way, so it
+// does not reveal which accounts exist.
+func handlerLoginUser(w http.ResponseWriter, r *http.Request, db database.Store, keys *keyset.Keyset, guard *loginGuard) {
 	decoder := json.NewDecoder(r.Body)
 	request := struct {
 		Email    string `json:"email"`
@@ -230,40 +370,107 @@ func handlerLoginUser(w http.ResponseWriter, r *http.Request, db *database.DB) {
 		return
 	}
 
+	account, ip := accountKey(request.Email), clientIP(r)
+	if wait := guard.reserve(account, ip); wait > 0 {
+		respondWithLoginThrottled(w, wait)
+		return
+	}
+
 	user, err := db.GetUserByEmail(request.Email)
+	if errors.Is(err, database.ErrNotFound) {
+		database.CompareDummyPassword(request.Password)
+		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "The user was not found")
+		guard.release(account, ip)
+		respondWithDBError(w, err, "Failed to load user")
 		return
 	}
 
-	err = user.ComparePassword(request.Password)
+	err = checkPassword(db, user, request.Password)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect Password")
+		respondWithError(w, http.StatusUnauthorized, "Invalid email or password")
+		return
+	}
+
+	if user.MFA.Enabled() {
+		// The password was right, but the login is only done once the code
+		// is checked.
+		guard.release(account, ip)
+		mfaToken, err := signMFAChallenge(keys, user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error getting a token")
+			return
+		}
+
+		respond := struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+		}
+
+		respondWithJSON(w, respond, http.StatusOK)
 		return
 	}
 
-	accessToken, err := generateJWT(user.ID)
+	guard.succeed(account, ip)
+	respondWithLogin(w, r, db, keys, user)
+}
+
+// checkPassword compares password with the one of user and, if it matches
+// but is hashed with outdated settings, hashes it again with the current ones.
+func checkPassword(db database.Store, user database.User, password string) error {
+	err := user.ComparePassword(password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting a token")
+		return err
+	}
+
+	if user.PasswordNeedsRehash() {
+		err := db.RehashPassword(user.ID, user.Password, password)
+		if err != nil {
+			log.Printf("Could not rehash the password of user %d: %v", user.ID, err)
+		}
+	}
+	return nil
+}
+
+// respondWithLogin starts a session for user and responds with its tokens.
+func respondWithLogin(w http.ResponseWriter, r *http.Request, db database.Store, keys *keyset.Keyset, user database.User) {
+	refreshToken, err := db.CreateRefreshToken(user.ID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		respondWithDBError(w, err, "Error creating a refresh token")
 		return
 	}
 
-	refreshToken, err := db.CreateRefreshToken(user.ID)
+	accessToken, err := generateJWT(keys, user.ID, refreshToken.FamilyID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error creating a refresh token")
+		respondWithError(w, http.StatusInternalServerError, "Error getting a token")
 		return
 	}
 
 	userRespond := struct {
-		ID           int    `json:"id"`
-		Email        string `json:"email"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
+		ID           int       `json:"id"`
+		Email        string    `json:"email"`
+		Handle       string    `json:"handle"`
+		IsChirpyRed  bool      `json:"is_chirpy_red"`
+		Verified     bool      `json:"verified"`
+		Roles        []string  `json:"roles"`
+		CreatedAt    time.Time `json:"created_at"`
+		UpdatedAt    time.Time `json:"updated_at"`
+		Token        string    `json:"token"`
+		RefreshToken string    `json:"refresh_token"`
 	}{
 		ID:           user.ID,
 		Email:        user.Email,
+		Handle:       user.Handle,
 		IsChirpyRed:  user.IsChirpyRed,
+		Verified:     user.Verified,
+		Roles:        user.Roles,
+		CreatedAt:    user.CreatedAt,
+		UpdatedAt:    user.UpdatedAt,
 		Token:        accessToken,
 		RefreshToken: refreshToken.Token,
 	}
@@ -271,19 +478,19 @@ func handlerLoginUser(w http.ResponseWriter, r *http.Request, db *database.DB) {
 	respondWithJSON(w, userRespond, http.StatusOK)
 }
 
-func generateJWT(userID int) (string, error) {
-	expiresInSeconds := 3600
-	claims := &jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		Subject:   fmt.Sprintf("%d", userID),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expiresInSeconds) * time.Second)),
+func generateJWT(keys *keyset.Keyset, userID, sessionID int) (string, error) {
+	claims := &accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   fmt.Sprintf("%d", userID),
+			Audience:  jwt.ClaimStrings{accessTokenAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(accessTokenLifetime)),
+		},
+		SessionID: strconv.Itoa(sessionID),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	jwtSecret := os.Getenv("JWT_SECRET")
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	tokenString, err := keys.Sign(claims)
 	if err != nil {
 		return "", err
 	}
@@ -291,74 +498,165 @@ func generateJWT(userID int) (string, error) {
 	return tokenString, nil
 }
 
-func handlerUpdateUser(w http.ResponseWriter, r *http.Request, db *database.DB) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
-		return
-	}
+// handlerJWKS publishes the public keys that verify access tokens, so other
+// services can check them without sharing a secret.
+func handlerJWKS(w http.ResponseWriter, r *http.Request, keys *keyset.Keyset) {
+	// Keep caches short so a rotated key is picked up well before the
+	// tokens it signs are used.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, keys.JWKS(), http.StatusOK)
+}
 
-	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+// handlerUpdateUser replaces the email and password of the user. It predates
+// handlerPatchUser and is kept for existing clients, but asks for the current
+// password and two-factor code the same way.
+func handlerUpdateUser(w http.ResponseWriter, r *http.Request, db database.Store, verifier *emailVerifier, guard *loginGuard) {
+	userId := requestUserID(r)
 
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		jwtSecret := os.Getenv("JWT_SECRET")
-		return []byte(jwtSecret), nil
-	})
-	if err != nil || !token.Valid {
-		respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
 
-	claims := token.Claims
-	userIdString, err := claims.GetSubject()
+	oldUser, err := db.GetUserByID(userId)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token claims")
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if !reauthenticate(w, r, db, guard, oldUser, request.CurrentPassword, request.Code) {
+		return
+	}
+	if changesEmail(oldUser, &request.Email) && !verifier.reserve(w, r, oldUser) {
 		return
 	}
 
-	userId, err := strconv.Atoi(userIdString)
+	storedUser, err := db.PatchUser(userId, requestSessionID(r), database.UserPatch{Email: &request.Email, Password: &request.Password})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldnt get userId")
+		respondWithDBError(w, err, "Failed to update user")
 		return
 	}
 
+	respondWithUpdatedUser(w, verifier, oldUser, storedUser)
+}
+
+// handlerPatchUser changes the fields of the user that the request sets.
+// Changing the email or the password takes the current password, and the
+// two-factor code if the user has one; the public profile fields do not.
+func handlerPatchUser(w http.ResponseWriter, r *http.Request, db database.Store, verifier *emailVerifier, guard *loginGuard) {
 	decoder := json.NewDecoder(r.Body)
 	request := struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		Code            string  `json:"code"`
+		Handle          *string `json:"handle"`
+		DisplayName     *string `json:"display_name"`
+		Bio             *string `json:"bio"`
+		AvatarURL       *string `json:"avatar_url"`
 	}{}
-	err = decoder.Decode(&request)
+	err := decoder.Decode(&request)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
 
-	updatedUser, err := database.NewUser(userId, request.Email, request.Password)
+	user, err := db.GetUserByID(requestUserID(r))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldnt create updated user")
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	patch := database.UserPatch{
+		Email:       request.Email,
+		Password:    request.Password,
+		Handle:      request.Handle,
+		DisplayName: request.DisplayName,
+		Bio:         request.Bio,
+		AvatarURL:   request.AvatarURL,
+	}
+	if patch == (database.UserPatch{}) {
+		respondWithUpdatedUser(w, verifier, user, user)
+		return
+	}
+
+	// The public profile is something users publish, like their chirps.
+	changesProfile := patch.Handle != nil || patch.DisplayName != nil || patch.Bio != nil || patch.AvatarURL != nil
+	if changesProfile && user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Your account is suspended")
+		return
+	}
+
+	// A stolen access token must not be enough to take the account over.
+	if patch.Email != nil || patch.Password != nil {
+		if !reauthenticate(w, r, db, guard, user, request.CurrentPassword, request.Code) {
+			return
+		}
+	}
+	if changesEmail(user, patch.Email) && !verifier.reserve(w, r, user) {
 		return
 	}
 
-	err = db.UpdateUser(*updatedUser)
+	storedUser, err := db.PatchUser(user.ID, requestSessionID(r), patch)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update user")
+		respondWithDBError(w, err, "Failed to update user")
 		return
 	}
 
+	respondWithUpdatedUser(w, verifier, user, storedUser)
+}
+
+// changesEmail reports whether setting email would change the address of
+// user, which sends a link to verify the new one.
+func changesEmail(user database.User, email *string) bool {
+	return email != nil && database.NormalizeEmail(*email) != database.NormalizeEmail(user.Email)
+}
+
+// respondWithUpdatedUser responds with storedUser and, if the update changed
+// the email of oldUser, sends a link to verify the new one.
+func respondWithUpdatedUser(w http.ResponseWriter, verifier *emailVerifier, oldUser, storedUser database.User) {
+	if changesEmail(oldUser, &storedUser.Email) {
+		verifier.send(storedUser)
+	}
+
 	userRespond := struct {
-		ID          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
+		ID          int       `json:"id"`
+		Email       string    `json:"email"`
+		Handle      string    `json:"handle"`
+		DisplayName string    `json:"display_name"`
+		Bio         string    `json:"bio"`
+		AvatarURL   string    `json:"avatar_url"`
+		IsChirpyRed bool      `json:"is_chirpy_red"`
+		Verified    bool      `json:"verified"`
+		Roles       []string  `json:"roles"`
+		CreatedAt   time.Time `json:"created_at"`
+		UpdatedAt   time.Time `json:"updated_at"`
 	}{
-		ID:          updatedUser.ID,
-		Email:       updatedUser.Email,
-		IsChirpyRed: updatedUser.IsChirpyRed,
+		ID:          storedUser.ID,
+		Email:       storedUser.Email,
+		Handle:      storedUser.Handle,
+		DisplayName: storedUser.DisplayName,
+		Bio:         storedUser.Bio,
+		AvatarURL:   storedUser.AvatarURL,
+		IsChirpyRed: storedUser.IsChirpyRed,
+		Verified:    storedUser.Verified,
+		Roles:       storedUser.Roles,
+		CreatedAt:   storedUser.CreatedAt,
+		UpdatedAt:   storedUser.UpdatedAt,
 	}
 
 	respondWithJSON(w, userRespond, http.StatusOK)
 }
 
-func handlerRefreshToken(w http.ResponseWriter, r *http.Request, db *database.DB) {
+func handlerRefreshToken(w http.ResponseWriter, r *http.Request, db database.Store, keys *keyset.Keyset) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
@@ -367,28 +665,36 @@ func handlerRefreshToken(w http.ResponseWriter, r *http.Request, db *database.DB
 
 	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
 
-	refreshToken, err := db.GetRefreshTokenInfo(tokenStr)
-	if err != nil || refreshToken.ExpiresAt.Before(time.Now()) {
+	// Every refresh token works once; a token presented twice revokes the
+	// login it belongs to.
+	refreshToken, err := db.RotateRefreshToken(tokenStr, r.UserAgent(), clientIP(r))
+	if errors.Is(err, database.ErrNotFound) || errors.Is(err, database.ErrRefreshTokenReused) {
 		respondWithError(w, http.StatusUnauthorized, "The refresh token is invalid")
 		return
 	}
+	if err != nil {
+		respondWithDBError(w, err, "Failed to rotate refresh token")
+		return
+	}
 
-	token, err := generateJWT(refreshToken.UserID)
+	token, err := generateJWT(keys, refreshToken.UserID, refreshToken.FamilyID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error getting a token")
 		return
 	}
 
 	respond := struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}{
-		Token: token,
+		Token:        token,
+		RefreshToken: refreshToken.Token,
 	}
 
 	respondWithJSON(w, respond, http.StatusOK)
 }
 
-func handlerRevokeToken(w http.ResponseWriter, r *http.Request, db *database.DB) {
+func handlerRevokeToken(w http.ResponseWriter, r *http.Request, db database.Store) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
@@ -398,21 +704,25 @@ func handlerRevokeToken(w http.ResponseWriter, r *http.Request, db *database.DB)
 	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
 
 	refreshToken, err := db.GetRefreshTokenInfo(tokenStr)
-	if err != nil || refreshToken.ExpiresAt.Before(time.Now()) {
+	if errors.Is(err, database.ErrNotFound) || (err == nil && refreshToken.ExpiresAt.Before(time.Now())) {
 		respondWithError(w, http.StatusUnauthorized, "The refresh token is invalid")
 		return
 	}
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load refresh token")
+		return
+	}
 
-	err = db.DeleteRefreshToken(refreshToken.Token)
+	err = db.DeleteRefreshTokenFamily(refreshToken.FamilyID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Failed to delete refresh token")
+		respondWithDBError(w, err, "Failed to delete refresh token")
 		return
 	}
 
 	respondWithJSON(w, struct{}{}, http.StatusNoContent)
 }
 
-func handlerWebhooks(w http.ResponseWriter, r *http.Request, db *database.DB) {
+func handlerWebhooks(w http.ResponseWriter, r *http.Request, db database.Store) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
@@ -446,7 +756,8 @@ func handlerWebhooks(w http.ResponseWriter, r *http.Request, db *database.DB) {
 
 	_, err = db.UpgradeToChirpyRed(request.Data.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "the user was not found")
+		respondWithDBError(w, err, "Failed to upgrade user")
+		return
 	}
 
 	respondWithJSON(w, struct{}{}, http.StatusNoContent)
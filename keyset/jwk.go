@@ -0,0 +1,55 @@
+package keyset
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// JWK is the public half of a key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	// Curve and X describe Ed25519 keys (RFC 8037).
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	// N and E describe RSA keys (RFC 7518).
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that verify tokens, including retiring keys
+// whose tokens may not have expired yet.
+func (keyset *Keyset) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range keyset.Keys() {
+		jwk := JWK{
+			Use:       "sig",
+			KeyID:     key.ID,
+			Algorithm: key.Algorithm,
+		}
+
+		switch publicKey := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
@@ -0,0 +1,335 @@
+package keyset
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Romasav/chirpy/atomicfile"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// Algorithms lists the signing algorithms a keyset can use.
+var Algorithms = []string{AlgorithmEdDSA, AlgorithmRS256}
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+const (
+	rsaKeyBits    = 2048
+	checkInterval = time.Minute
+)
+
+type Options struct {
+	// Algorithm is used for new keys. When it no longer matches the active
+	// key, the active key is rotated.
+	Algorithm string
+	// RotateEvery is how long a key signs tokens before it is replaced.
+	RotateEvery time.Duration
+	// RetainFor is how long a replaced key is still published so the tokens
+	// it signed can be verified. It should cover the token lifetime.
+	RetainFor time.Duration
+}
+
+// Key is a signing key. The active key has no RetiredAt.
+type Key struct {
+	ID        string
+	Algorithm string
+	CreatedAt time.Time
+	RetiredAt *time.Time
+	signer    crypto.Signer
+}
+
+type storedKey struct {
+	ID         string     `json:"kid"`
+	Algorithm  string     `json:"alg"`
+	PrivateKey string     `json:"private_key"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RetiredAt  *time.Time `json:"retired_at,omitempty"`
+}
+
+type keysetFile struct {
+	Keys []storedKey `json:"keys"`
+}
+
+// Keyset signs tokens with its active key and verifies them with any key it
+// still publishes. Keys are kept in a JSON file and rotated on a schedule by
+// a background goroutine.
+type Keyset struct {
+	path      string
+	options   Options
+	mux       sync.RWMutex
+	keys      []Key
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func Open(path string, options Options) (*Keyset, error) {
+	if signingMethod(options.Algorithm) == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", options.Algorithm)
+	}
+	if options.RotateEvery <= 0 {
+		return nil, errors.New("the key rotation interval must be positive")
+	}
+
+	keyset := Keyset{
+		path:    path,
+		options: options,
+		done:    make(chan struct{}),
+	}
+
+	err := keyset.load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = keyset.rotateIfDue(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	go keyset.watch()
+
+	return &keyset, nil
+}
+
+func (keyset *Keyset) Close() error {
+	keyset.closeOnce.Do(func() {
+		close(keyset.done)
+	})
+	return nil
+}
+
+// Sign signs claims with the active key and names the key in the kid header.
+func (keyset *Keyset) Sign(claims jwt.Claims) (string, error) {
+	keyset.mux.RLock()
+	defer keyset.mux.RUnlock()
+
+	active := keyset.keys[len(keyset.keys)-1]
+	token := jwt.NewWithClaims(signingMethod(active.Algorithm), claims)
+	token.Header["kid"] = active.ID
+	return token.SignedString(active.signer)
+}
+
+// Keyfunc returns the public key named by the kid header of token, for use
+// with jwt.Parse.
+func (keyset *Keyset) Keyfunc(token *jwt.Token) (interface{}, error) {
+	keyID, _ := token.Header["kid"].(string)
+
+	keyset.mux.RLock()
+	defer keyset.mux.RUnlock()
+
+	for _, key := range keyset.keys {
+		if key.ID != keyID {
+			continue
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %q is for %s, not %s", keyID, key.Algorithm, token.Method.Alg())
+		}
+		return key.signer.Public(), nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+}
+
+// Keys returns the published keys, oldest first.
+func (keyset *Keyset) Keys() []Key {
+	keyset.mux.RLock()
+	defer keyset.mux.RUnlock()
+
+	keys := make([]Key, len(keyset.keys))
+	copy(keys, keyset.keys)
+	return keys
+}
+
+// rotateIfDue drops retired keys past their retention and replaces the
+// active key when it is too old or uses another algorithm.
+func (keyset *Keyset) rotateIfDue(now time.Time) error {
+	keyset.mux.Lock()
+	defer keyset.mux.Unlock()
+
+	keys := []Key{}
+	for _, key := range keyset.keys {
+		if key.RetiredAt == nil || now.Before(key.RetiredAt.Add(keyset.options.RetainFor)) {
+			keys = append(keys, key)
+		}
+	}
+	changed := len(keys) != len(keyset.keys)
+
+	if len(keys) == 0 || keyset.dueLocked(keys[len(keys)-1], now) {
+		newKey, err := generateKey(keyset.options.Algorithm, now)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			retiredAt := now
+			keys[len(keys)-1].RetiredAt = &retiredAt
+		}
+		keys = append(keys, newKey)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	err := keyset.saveLocked(keys)
+	if err != nil {
+		return err
+	}
+	keyset.keys = keys
+	return nil
+}
+
+func (keyset *Keyset) dueLocked(active Key, now time.Time) bool {
+	return active.Algorithm != keyset.options.Algorithm || !now.Before(active.CreatedAt.Add(keyset.options.RotateEvery))
+}
+
+func (keyset *Keyset) watch() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-keyset.done:
+			return
+		case <-ticker.C:
+			err := keyset.rotateIfDue(time.Now().UTC())
+			if err != nil {
+				log.Printf("Could not rotate the signing keys: %v", err)
+			}
+		}
+	}
+}
+
+func generateKey(algorithm string, now time.Time) (Key, error) {
+	var signer crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	idBytes := make([]byte, 8)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return Key{}, err
+	}
+
+	return Key{
+		ID:        hex.EncodeToString(idBytes),
+		Algorithm: algorithm,
+		CreatedAt: now,
+		signer:    signer,
+	}, nil
+}
+
+func signingMethod(algorithm string) jwt.SigningMethod {
+	switch algorithm {
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256
+	default:
+		return nil
+	}
+}
+
+// load reads the keyset file. A missing file is an empty keyset.
+func (keyset *Keyset) load() error {
+	data, err := os.ReadFile(keyset.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file keysetFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("keyset %s: %w", keyset.path, err)
+	}
+
+	keys := []Key{}
+	for _, stored := range file.Keys {
+		block, _ := pem.Decode([]byte(stored.PrivateKey))
+		if block == nil {
+			return fmt.Errorf("keyset %s: key %q has no PEM private key", keyset.path, stored.ID)
+		}
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("keyset %s: key %q: %w", keyset.path, stored.ID, err)
+		}
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok || signingMethod(stored.Algorithm) == nil {
+			return fmt.Errorf("keyset %s: key %q has unsupported algorithm %q", keyset.path, stored.ID, stored.Algorithm)
+		}
+
+		keys = append(keys, Key{
+			ID:        stored.ID,
+			Algorithm: stored.Algorithm,
+			CreatedAt: stored.CreatedAt,
+			RetiredAt: stored.RetiredAt,
+			signer:    signer,
+		})
+	}
+
+	keyset.keys = keys
+	return nil
+}
+
+// saveLocked writes keys to the keyset file, replacing it atomically. The
+// file holds private keys, so only the owner can read it.
+func (keyset *Keyset) saveLocked(keys []Key) error {
+	file := keysetFile{Keys: []storedKey{}}
+	for _, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key.signer)
+		if err != nil {
+			return err
+		}
+
+		file.Keys = append(file.Keys, storedKey{
+			ID:         key.ID,
+			Algorithm:  key.Algorithm,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			CreatedAt:  key.CreatedAt,
+			RetiredAt:  key.RetiredAt,
+		})
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(keyset.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(keyset.path, data, 0600)
+}
@@ -0,0 +1,144 @@
+package keyset
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func sign(t *testing.T, keyset *Keyset) string {
+	t.Helper()
+	token, err := keyset.Sign(jwt.RegisteredClaims{Subject: "1"})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return token
+}
+
+func verify(keyset *Keyset, token string) error {
+	_, err := jwt.Parse(token, keyset.Keyfunc, jwt.WithValidMethods(Algorithms))
+	return err
+}
+
+// TestRotation replaces the active key every RotateEvery and keeps publishing
+// a replaced key for RetainFor, so that the tokens it signed still verify
+// until then and no longer after.
+func TestRotation(t *testing.T) {
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keyset.json")
+			keyset, err := Open(path, Options{Algorithm: algorithm, RotateEvery: time.Hour, RetainFor: 30 * time.Minute})
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer keyset.Close()
+
+			first := keyset.Keys()[0]
+			oldToken := sign(t, keyset)
+
+			tests := []struct {
+				name          string
+				after         time.Duration
+				wantKeys      int
+				wantOldVerify bool
+			}{
+				{"before the rotation", 59 * time.Minute, 1, true},
+				{"rotated", time.Hour, 2, true},
+				{"within the retention", time.Hour + 29*time.Minute, 2, true},
+				{"after the retention", time.Hour + 30*time.Minute, 1, false},
+			}
+			for _, test := range tests {
+				err := keyset.rotateIfDue(first.CreatedAt.Add(test.after))
+				if err != nil {
+					t.Fatalf("%s: rotateIfDue: %v", test.name, err)
+				}
+
+				keys := keyset.Keys()
+				if len(keys) != test.wantKeys {
+					t.Errorf("%s: %d keys, want %d", test.name, len(keys), test.wantKeys)
+				}
+				for i, key := range keys {
+					if active := i == len(keys)-1; active != (key.RetiredAt == nil) {
+						t.Errorf("%s: key %d has RetiredAt %v", test.name, i, key.RetiredAt)
+					}
+				}
+
+				err = verify(keyset, oldToken)
+				if (err == nil) != test.wantOldVerify {
+					t.Errorf("%s: verifying the old token: %v", test.name, err)
+				}
+				if !test.wantOldVerify && !errors.Is(err, ErrUnknownKey) {
+					t.Errorf("%s: got %v, want ErrUnknownKey", test.name, err)
+				}
+				if err := verify(keyset, sign(t, keyset)); err != nil {
+					t.Errorf("%s: verifying a new token: %v", test.name, err)
+				}
+			}
+
+			// The keys survive a restart.
+			reopened, err := Open(path, Options{Algorithm: algorithm, RotateEvery: time.Hour, RetainFor: 30 * time.Minute})
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			defer reopened.Close()
+			if err := verify(reopened, sign(t, keyset)); err != nil {
+				t.Errorf("verifying after reopening: %v", err)
+			}
+		})
+	}
+}
+
+// TestAlgorithmChange rotates the active key as soon as the configured
+// algorithm changes, and keeps the old key for the tokens it signed.
+func TestAlgorithmChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyset.json")
+	options := Options{Algorithm: AlgorithmRS256, RotateEvery: time.Hour, RetainFor: time.Hour}
+	keyset, err := Open(path, options)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	oldToken := sign(t, keyset)
+	keyset.Close()
+
+	options.Algorithm = AlgorithmEdDSA
+	keyset, err = Open(path, options)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer keyset.Close()
+
+	keys := keyset.Keys()
+	if len(keys) != 2 || keys[0].Algorithm != AlgorithmRS256 || keys[1].Algorithm != AlgorithmEdDSA {
+		t.Fatalf("keys = %+v, want the RS256 key retired for an EdDSA one", keys)
+	}
+	if err := verify(keyset, oldToken); err != nil {
+		t.Errorf("verifying a token of the old key: %v", err)
+	}
+}
+
+// TestKeyfuncRejectsAlgorithmMismatch refuses a token whose header names a
+// key with another algorithm than the key has.
+func TestKeyfuncRejectsAlgorithmMismatch(t *testing.T) {
+	keyset, err := Open(filepath.Join(t.TempDir(), "keyset.json"), Options{Algorithm: AlgorithmEdDSA, RotateEvery: time.Hour})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer keyset.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	token.Header["kid"] = keyset.Keys()[0].ID
+	signed, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+
+	if _, err := keyset.Keyfunc(token); err == nil {
+		t.Errorf("Keyfunc accepted an HS256 token for an EdDSA key")
+	}
+	if _, err := jwt.Parse(signed, keyset.Keyfunc); err == nil {
+		t.Errorf("Parse accepted an HS256 token for an EdDSA key")
+	}
+}
@@ -0,0 +1,172 @@
+package lockout
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy decides how a Tracker slows a key down as its failures add up.
+type Policy struct {
+	// FreeAttempts is how many failures are allowed without any delay.
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past FreeAttempts. It
+	// doubles with every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter is the number of failures that locks a key out for
+	// LockoutDuration. Every failure after that locks it out again. Zero
+	// never locks a key out.
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// ResetAfter is how long a key is remembered after its last failure
+	// once it is no longer blocked.
+	ResetAfter time.Duration
+}
+
+// Status is what a Tracker remembers about a key.
+type Status struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	// BlockedUntil is when the key may try again.
+	BlockedUntil time.Time
+	// LockedOut is set once the key reached Policy.LockoutAfter.
+	LockedOut bool
+}
+
+// Tracker counts the failed attempts of keys, such as accounts or client
+// addresses, and tells how long each must wait before trying again. It only
+// keeps its state in memory.
+type Tracker struct {
+	policy Policy
+
+	mux       sync.Mutex
+	statuses  map[string]*Status
+	lastPrune time.Time
+}
+
+func NewTracker(policy Policy) *Tracker {
+	return &Tracker{
+		policy:    policy,
+		statuses:  map[string]*Status{},
+		lastPrune: time.Now(),
+	}
+}
+
+// Reserve is called before an attempt of key is checked. Unless key must
+// wait, it counts the attempt as failed right away and returns zero;
+// otherwise it counts nothing and returns how long key must wait. Checking and
+// counting under one lock keeps concurrent attempts from all passing the
+// check before any of them is counted. An attempt that turns out not to have
+// failed is taken back with Release or Reset.
+func (tracker *Tracker) Reserve(key string) time.Duration {
+	tracker.mux.Lock()
+	defer tracker.mux.Unlock()
+
+	now := time.Now()
+	if now.Sub(tracker.lastPrune) > tracker.policy.ResetAfter {
+		tracker.prune(now)
+	}
+
+	status, tracked := tracker.statuses[key]
+	if !tracked || tracker.expired(status, now) {
+		status = &Status{Key: key}
+		tracker.statuses[key] = status
+	}
+	if wait := status.BlockedUntil.Sub(now); wait > 0 {
+		return wait
+	}
+
+	status.Failures++
+	status.LastFailure = now
+	tracker.block(status)
+	return 0
+}
+
+// Release takes back an attempt counted by Reserve that did not fail.
+func (tracker *Tracker) Release(key string) {
+	tracker.mux.Lock()
+	defer tracker.mux.Unlock()
+
+	status, tracked := tracker.statuses[key]
+	if !tracked {
+		return
+	}
+
+	status.Failures--
+	if status.Failures <= 0 {
+		delete(tracker.statuses, key)
+		return
+	}
+	tracker.block(status)
+}
+
+// block sets how long status is blocked after its last failure.
+func (tracker *Tracker) block(status *Status) {
+	delay := tracker.delay(status.Failures)
+	status.LockedOut = tracker.policy.LockoutAfter > 0 && status.Failures >= tracker.policy.LockoutAfter
+	if status.LockedOut {
+		delay = tracker.policy.LockoutDuration
+	}
+	status.BlockedUntil = status.LastFailure.Add(delay)
+}
+
+// delay is the backoff after the given number of failures.
+func (tracker *Tracker) delay(failures int) time.Duration {
+	extra := failures - tracker.policy.FreeAttempts
+	if extra <= 0 {
+		return 0
+	}
+
+	delay := tracker.policy.BaseDelay
+	for i := 1; i < extra && delay < tracker.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, tracker.policy.MaxDelay)
+}
+
+// Reset forgets the failures of key, such as after a successful attempt, and
+// reports whether there were any.
+func (tracker *Tracker) Reset(key string) bool {
+	tracker.mux.Lock()
+	defer tracker.mux.Unlock()
+
+	status, tracked := tracker.statuses[key]
+	delete(tracker.statuses, key)
+	return tracked && !tracker.expired(status, time.Now())
+}
+
+// List returns the keys with failures that are still remembered, sorted by
+// key.
+func (tracker *Tracker) List() []Status {
+	tracker.mux.Lock()
+	defer tracker.mux.Unlock()
+
+	now := time.Now()
+	statuses := []Status{}
+	for _, status := range tracker.statuses {
+		if !tracker.expired(status, now) {
+			statuses = append(statuses, *status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Key < statuses[j].Key
+	})
+	return statuses
+}
+
+func (tracker *Tracker) expired(status *Status, now time.Time) bool {
+	return now.After(status.BlockedUntil) && now.Sub(status.LastFailure) > tracker.policy.ResetAfter
+}
+
+// prune forgets expired keys, so that guessing with many different keys does
+// not grow the tracker forever.
+func (tracker *Tracker) prune(now time.Time) {
+	for key, status := range tracker.statuses {
+		if tracker.expired(status, now) {
+			delete(tracker.statuses, key)
+		}
+	}
+	tracker.lastPrune = now
+}
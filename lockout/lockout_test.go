@@ -0,0 +1,205 @@
+package lockout
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	tracker := NewTracker(Policy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     10 * time.Second,
+	})
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := tracker.delay(test.failures); got != test.want {
+			t.Errorf("delay(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
+
+// TestReserve counts every attempt as it is reserved: the free attempts pass,
+// the one after them starts the backoff, and a blocked key is refused without
+// being counted again.
+func TestReserve(t *testing.T) {
+	tracker := NewTracker(Policy{
+		FreeAttempts: 2,
+		BaseDelay:    time.Hour,
+		MaxDelay:     time.Hour,
+		ResetAfter:   time.Hour,
+	})
+
+	tests := []struct {
+		name         string
+		wantWait     bool
+		wantFailures int
+	}{
+		{"first free attempt", false, 1},
+		{"second free attempt", false, 2},
+		{"attempt that starts the backoff", false, 3},
+		{"blocked", true, 3},
+		{"still blocked", true, 3},
+	}
+	for _, test := range tests {
+		wait := tracker.Reserve("alice")
+		if (wait > 0) != test.wantWait {
+			t.Errorf("%s: Reserve waits %v, want waiting %v", test.name, wait, test.wantWait)
+		}
+		if failures := failuresOf(tracker, "alice"); failures != test.wantFailures {
+			t.Errorf("%s: %d failures, want %d", test.name, failures, test.wantFailures)
+		}
+	}
+
+	if wait := tracker.Reserve("bob"); wait > 0 {
+		t.Errorf("another key waits %v", wait)
+	}
+}
+
+// TestRelease takes back attempts that did not fail, and lifts the backoff
+// they started.
+func TestRelease(t *testing.T) {
+	tracker := NewTracker(Policy{
+		FreeAttempts: 1,
+		BaseDelay:    time.Hour,
+		MaxDelay:     time.Hour,
+		ResetAfter:   time.Hour,
+	})
+
+	tracker.Reserve("alice")
+	tracker.Reserve("alice")
+	if wait := tracker.Reserve("alice"); wait <= 0 {
+		t.Fatalf("Reserve did not block after the backoff started")
+	}
+
+	tracker.Release("alice")
+	if failures := failuresOf(tracker, "alice"); failures != 1 {
+		t.Errorf("%d failures after Release, want 1", failures)
+	}
+	if wait := tracker.Reserve("alice"); wait > 0 {
+		t.Errorf("Reserve waits %v after Release", wait)
+	}
+
+	tracker.Release("alice")
+	tracker.Release("alice")
+	if statuses := tracker.List(); len(statuses) != 0 {
+		t.Errorf("List = %v after releasing every attempt, want none", statuses)
+	}
+
+	// Releasing a key that is not tracked does nothing.
+	tracker.Release("nobody")
+}
+
+func TestLockout(t *testing.T) {
+	tracker := NewTracker(Policy{
+		FreeAttempts:    10,
+		LockoutAfter:    3,
+		LockoutDuration: time.Hour,
+		ResetAfter:      time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		if wait := tracker.Reserve("alice"); wait > 0 {
+			t.Fatalf("attempt %d waits %v", i+1, wait)
+		}
+	}
+
+	wait := tracker.Reserve("alice")
+	if wait < 59*time.Minute {
+		t.Errorf("Reserve waits %v after the lockout, want about an hour", wait)
+	}
+
+	statuses := tracker.List()
+	if len(statuses) != 1 || !statuses[0].LockedOut {
+		t.Fatalf("List = %v, want alice locked out", statuses)
+	}
+
+	if !tracker.Reset("alice") {
+		t.Errorf("Reset reported no failures")
+	}
+	if tracker.Reset("alice") {
+		t.Errorf("Reset reported failures twice")
+	}
+	if wait := tracker.Reserve("alice"); wait > 0 {
+		t.Errorf("Reserve waits %v after Reset", wait)
+	}
+}
+
+// TestExpiry forgets a key ResetAfter its last failure.
+func TestExpiry(t *testing.T) {
+	tracker := NewTracker(Policy{
+		FreeAttempts: 1,
+		BaseDelay:    10 * time.Millisecond,
+		MaxDelay:     10 * time.Millisecond,
+		ResetAfter:   20 * time.Millisecond,
+	})
+
+	tracker.Reserve("alice")
+	tracker.Reserve("alice")
+	time.Sleep(50 * time.Millisecond)
+
+	if statuses := tracker.List(); len(statuses) != 0 {
+		t.Errorf("List = %v after ResetAfter, want none", statuses)
+	}
+	tracker.Reserve("alice")
+	if failures := failuresOf(tracker, "alice"); failures != 1 {
+		t.Errorf("%d failures after expiry, want 1", failures)
+	}
+}
+
+// TestConcurrentReserve reserves from many goroutines at once. Run it with
+// -race: only the free attempts and the one that starts the backoff may pass.
+func TestConcurrentReserve(t *testing.T) {
+	const goroutines = 50
+	tracker := NewTracker(Policy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Hour,
+		MaxDelay:     time.Hour,
+		ResetAfter:   time.Hour,
+	})
+
+	var wg sync.WaitGroup
+	results := make(chan bool, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- tracker.Reserve("alice") == 0
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	count := 0
+	for ok := range results {
+		if ok {
+			count++
+		}
+	}
+	if count != 4 {
+		t.Errorf("%d of %d attempts passed, want 4", count, goroutines)
+	}
+}
+
+func failuresOf(tracker *Tracker, key string) int {
+	for _, status := range tracker.List() {
+		if status.Key == key {
+			return status.Failures
+		}
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/lockout"
+)
+
+// loginGuard slows down guessing of passwords and two-factor codes. Failed
+// logins are counted per account, so that spreading guesses over many
+// addresses does not help, and per client IP, so that spreading them over
+// many accounts does not either.
+type loginGuard struct {
+	accounts *lockout.Tracker
+	ips      *lockout.Tracker
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{
+		accounts: lockout.NewTracker(lockout.Policy{
+			FreeAttempts:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			LockoutAfter:    10,
+			LockoutDuration: 15 * time.Minute,
+			ResetAfter:      time.Hour,
+		}),
+		ips: lockout.NewTracker(lockout.Policy{
+			FreeAttempts:    10,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			LockoutAfter:    100,
+			LockoutDuration: time.Hour,
+			ResetAfter:      time.Hour,
+		}),
+	}
+}
+
+// passwordResetGuard limits the requests for password reset emails. Every
+// request counts, whether the email belongs to an account or not. A client is
+// limited per email it asks for, so that nobody can use up the requests of an
+// account they do not own; looser limits per email and per client IP cap how
+// often one inbox is mailed and how many a client can mail.
+type passwordResetGuard struct {
+	requests *lockout.Tracker
+	emails   *lockout.Tracker
+	ips      *lockout.Tracker
+}
+
+func newPasswordResetGuard() *passwordResetGuard {
+	return &passwordResetGuard{
+		requests: lockout.NewTracker(lockout.Policy{
+			FreeAttempts: 3,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		}),
+		emails: lockout.NewTracker(lockout.Policy{
+			FreeAttempts: 20,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		}),
+		ips: lockout.NewTracker(lockout.Policy{
+			FreeAttempts: 10,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		}),
+	}
+}
+
+// reserve counts a reset request for email from ip, or returns how long it
+// must wait instead. The limit per email is checked last, so that requests
+// refused for the client do not count against the email.
+func (guard *passwordResetGuard) reserve(email, ip string) time.Duration {
+	account := accountKey(email)
+	// IPs contain no spaces, so the key cannot be mistaken for another pair.
+	request := ip + " " + account
+	if wait := guard.requests.Reserve(request); wait > 0 {
+		return wait
+	}
+	if wait := guard.ips.Reserve(ip); wait > 0 {
+		guard.requests.Release(request)
+		return wait
+	}
+	if wait := guard.emails.Reserve(account); wait > 0 {
+		guard.requests.Release(request)
+		guard.ips.Release(ip)
+		return wait
+	}
+	return 0
+}
+
+// newEmailVerificationGuard limits how often verification links are sent,
+// counted per user and per client IP, so that signing up with someone else's
+// address cannot be used to flood their inbox.
+func newEmailVerificationGuard() *loginGuard {
+	return &loginGuard{
+		accounts: lockout.NewTracker(lockout.Policy{
+			FreeAttempts: 3,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		}),
+		ips: lockout.NewTracker(lockout.Policy{
+			FreeAttempts: 10,
+			BaseDelay:    time.Minute,
+			MaxDelay:     time.Hour,
+			ResetAfter:   time.Hour,
+		}),
+	}
+}
+
+// accountKey is the key failed logins to the account with email are counted
+// under, whether the account exists or not.
+func accountKey(email string) string {
+	return database.NormalizeEmail(email)
+}
+
+// reserve counts a login to account from ip as failed before it is checked,
+// or returns how long it must wait instead. A reserved login that does not
+// fail ends with succeed or release.
+func (guard *loginGuard) reserve(account, ip string) time.Duration {
+	if wait := guard.accounts.Reserve(account); wait > 0 {
+		return wait
+	}
+	if wait := guard.ips.Reserve(ip); wait > 0 {
+		guard.accounts.Release(account)
+		return wait
+	}
+	return 0
+}
+
+// release takes back a reserved login that neither failed nor succeeded, such
+// as one that needs a two-factor code or ran into a server error.
+func (guard *loginGuard) release(account, ip string) {
+	guard.accounts.Release(account)
+	guard.ips.Release(ip)
+}
+
+// succeed forgets the failed logins of account. Those of the IP are kept, so
+// that logging into an account of one's own does not reset them.
+func (guard *loginGuard) succeed(account, ip string) {
+	guard.accounts.Reset(account)
+	guard.ips.Release(ip)
+}
+
+func respondWithLoginThrottled(w http.ResponseWriter, wait time.Duration) {
+	respondWithThrottled(w, wait, "Too many failed login attempts, try again later")
+}
+
+// respondWithThrottled refuses a request that has to wait, telling the client
+// for how long.
+func respondWithThrottled(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, msg)
+}
+
+// lockoutResponse is how a tracked account or IP is shown to admins.
+type lockoutResponse struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	BlockedUntil  *time.Time `json:"blocked_until"`
+	LockedOut     bool       `json:"locked_out"`
+}
+
+func newLockoutResponses(statuses []lockout.Status) []lockoutResponse {
+	now := time.Now()
+	responses := []lockoutResponse{}
+	for _, status := range statuses {
+		response := lockoutResponse{
+			Key:           status.Key,
+			Failures:      status.Failures,
+			LastFailureAt: status.LastFailure.UTC(),
+			LockedOut:     status.LockedOut,
+		}
+		if status.BlockedUntil.After(now) {
+			blockedUntil := status.BlockedUntil.UTC()
+			response.BlockedUntil = &blockedUntil
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+func handlerGetLockouts(w http.ResponseWriter, r *http.Request, guard *loginGuard) {
+	respond := struct {
+		Accounts []lockoutResponse `json:"accounts"`
+		IPs      []lockoutResponse `json:"ips"`
+	}{
+		Accounts: newLockoutResponses(guard.accounts.List()),
+		IPs:      newLockoutResponses(guard.ips.List()),
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
+
+// handlerClearAccountLockout forgets the failed logins of an account, such as
+// for a user locked out by someone else guessing their password.
+func handlerClearAccountLockout(w http.ResponseWriter, r *http.Request, guard *loginGuard) {
+	clearLockout(w, guard.accounts, accountKey(r.PathValue("email")))
+}
+
+func handlerClearIPLockout(w http.ResponseWriter, r *http.Request, guard *loginGuard) {
+	clearLockout(w, guard.ips, r.PathValue("ip"))
+}
+
+func clearLockout(w http.ResponseWriter, tracker *lockout.Tracker, key string) {
+	if !tracker.Reset(key) {
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("no failed logins are recorded for %v", key))
+		return
+	}
+
+	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+}
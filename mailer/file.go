@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileMailer writes messages to a file or to stdout instead of sending them,
+// for local development and tests.
+type FileMailer struct {
+	mux  sync.Mutex
+	out  io.Writer
+	file *os.File
+}
+
+// NewFile appends messages to the file at path, or writes them to stdout if
+// path is empty or "-". The messages contain secrets such as reset tokens,
+// so the file is only readable by its owner.
+func NewFile(path string) (*FileMailer, error) {
+	if path == "" || path == "-" {
+		return &FileMailer{out: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileMailer{out: file, file: file}, nil
+}
+
+func (mailer *FileMailer) Send(message Message) error {
+	err := message.validate()
+	if err != nil {
+		return err
+	}
+
+	mailer.mux.Lock()
+	defer mailer.mux.Unlock()
+
+	_, err = fmt.Fprintf(mailer.out, "----- %s\nTo: %s\nSubject: %s\n\n%s\n",
+		time.Now().UTC().Format(time.RFC3339), message.To, message.Subject, message.Body)
+	return err
+}
+
+func (mailer *FileMailer) Close() error {
+	if mailer.file == nil {
+		return nil
+	}
+	return mailer.file.Close()
+}
@@ -0,0 +1,28 @@
+package mailer
+
+import (
+	"errors"
+	"strings"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(message Message) error
+}
+
+var errHeaderInjection = errors.New("the recipient and subject must be a single line")
+
+// validate refuses header values that would let a caller add headers of
+// their own.
+func (message Message) validate() error {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return errHeaderInjection
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SMTPConfig struct {
+	Host string
+	Port int
+	// Username and Password are optional. Credentials are only sent over
+	// TLS, or to localhost.
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPMailer delivers messages to an SMTP server, using STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from *mail.Address
+}
+
+func NewSMTP(config SMTPConfig) (*SMTPMailer, error) {
+	if config.Host == "" {
+		return nil, errors.New("the SMTP host is not set")
+	}
+	if config.Port <= 0 {
+		config.Port = 587
+	}
+
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", config.From, err)
+	}
+
+	mailer := SMTPMailer{
+		addr: net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		from: from,
+	}
+	if config.Username != "" {
+		mailer.auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	return &mailer, nil
+}
+
+func (mailer *SMTPMailer) Send(message Message) error {
+	err := message.validate()
+	if err != nil {
+		return err
+	}
+
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %w", message.To, err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", mailer.from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return smtp.SendMail(mailer.addr, mailer.auth, mailer.from.Address, []string{to.Address}, buf.Bytes())
+}
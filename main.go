@@ -4,39 +4,192 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/keyset"
+	"github.com/Romasav/chirpy/mailer"
+	"github.com/Romasav/chirpy/moderation"
 	"github.com/joho/godotenv"
 )
 
 func main() {
 	godotenv.Load()
 
+	dbDriver := os.Getenv("CHIRPY_DB_DRIVER")
+	if dbDriver == "" {
+		dbDriver = database.DriverJSON
+	}
+
 	dbPath := os.Getenv("CHIRPY_DB_PATH")
 	if dbPath == "" {
-		dbPath = "database.json"
+		dbPath = database.DefaultPath(dbDriver)
+	}
+
+	dbWAL := false
+	if walSetting := os.Getenv("CHIRPY_DB_WAL"); walSetting != "" {
+		var err error
+		dbWAL, err = strconv.ParseBool(walSetting)
+		if err != nil {
+			log.Fatalf("Invalid CHIRPY_DB_WAL: %v", err)
+		}
+	}
+
+	dbWALCompactEvery := 0
+	if compactSetting := os.Getenv("CHIRPY_DB_WAL_COMPACT_EVERY"); compactSetting != "" {
+		var err error
+		dbWALCompactEvery, err = strconv.Atoi(compactSetting)
+		if err != nil {
+			log.Fatalf("Invalid CHIRPY_DB_WAL_COMPACT_EVERY: %v", err)
+		}
+	}
+
+	moderationPath := os.Getenv("CHIRPY_MODERATION_PATH")
+	if moderationPath == "" {
+		moderationPath = "moderation.json"
+	}
+
+	keysetPath := os.Getenv("CHIRPY_KEYSET_PATH")
+	if keysetPath == "" {
+		keysetPath = "keyset.json"
+	}
+
+	jwtAlgorithm := os.Getenv("CHIRPY_JWT_ALGORITHM")
+	if jwtAlgorithm == "" {
+		jwtAlgorithm = keyset.AlgorithmEdDSA
+	}
+
+	keyRotation := 30 * 24 * time.Hour
+	if rotationSetting := os.Getenv("CHIRPY_KEY_ROTATION"); rotationSetting != "" {
+		var err error
+		keyRotation, err = time.ParseDuration(rotationSetting)
+		if err != nil {
+			log.Fatalf("Invalid CHIRPY_KEY_ROTATION: %v", err)
+		}
+	}
+
+	publicURL := strings.TrimSuffix(os.Getenv("CHIRPY_PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = "http://localhost:8080"
+	}
+
+	requireVerified := false
+	if requireSetting := os.Getenv("CHIRPY_REQUIRE_VERIFIED_EMAIL"); requireSetting != "" {
+		var err error
+		requireVerified, err = strconv.ParseBool(requireSetting)
+		if err != nil {
+			log.Fatalf("Invalid CHIRPY_REQUIRE_VERIFIED_EMAIL: %v", err)
+		}
+	}
+
+	tokenSweepInterval := time.Hour
+	if sweepSetting := os.Getenv("CHIRPY_TOKEN_SWEEP_INTERVAL"); sweepSetting != "" {
+		var err error
+		tokenSweepInterval, err = time.ParseDuration(sweepSetting)
+		if err != nil || tokenSweepInterval <= 0 {
+			log.Fatalf("Invalid CHIRPY_TOKEN_SWEEP_INTERVAL: %q", sweepSetting)
+		}
+	}
+
+	passwords, err := passwordConfig()
+	if err != nil {
+		log.Fatalf("Invalid password settings: %v", err)
+	}
+	err = database.SetPasswordConfig(passwords)
+	if err != nil {
+		log.Fatalf("Invalid password settings: %v", err)
 	}
 
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Report pending database migrations and exit")
+	grantAdmin := flag.String("grant-admin", "", "Give the admin role to the user with this email and exit")
 	flag.Parse()
+
+	dbConfig := database.Config{
+		Driver:          dbDriver,
+		Path:            dbPath,
+		WAL:             dbWAL,
+		WALCompactEvery: dbWALCompactEvery,
+	}
+
+	if *migrateDryRun {
+		report, err := database.PlanMigrations(dbConfig)
+		if err != nil {
+			log.Fatalf("Could not plan migrations: %v", err)
+		}
+		fmt.Print(report)
+		return
+	}
+
 	if *dbg {
-		fmt.Println("Debug mode enabled: Deleting database...")
-		err := os.Remove(dbPath)
-		if err != nil && !os.IsNotExist(err) {
-			fmt.Printf("Failed to delete database: %v\n", err)
+		log.Printf("Debug mode enabled: deleting the database at %s", dbPath)
+		err := database.Remove(dbConfig)
+		if err != nil {
+			log.Fatalf("Could not delete the database: %v", err)
 		}
-		fmt.Println("Deletion was successful")
 	}
 
 	const filepathRoot = "."
 	const port = "8080"
 	apiConfig := apiConfig{}
 
-	db, err := database.NewDB(dbPath)
+	db, err := database.Open(dbConfig)
 	if err != nil {
-		log.Fatal("Could not create new database")
+		log.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+
+	if *grantAdmin != "" {
+		user, err := grantRole(db, *grantAdmin, database.RoleAdmin)
+		if err != nil {
+			log.Fatalf("Could not grant the admin role: %v", err)
+		}
+		fmt.Printf("%s now has the roles %v\n", user.Email, user.Roles)
+		return
+	}
+
+	moderator, err := moderation.NewEngine(moderationPath)
+	if err != nil {
+		log.Fatalf("Could not load moderation rules: %v", err)
+	}
+	defer moderator.Close()
+
+	keys, err := keyset.Open(keysetPath, keyset.Options{
+		Algorithm:   jwtAlgorithm,
+		RotateEvery: keyRotation,
+		// A retired key must outlive every token it signed.
+		RetainFor: max(accessTokenLifetime, emailVerificationLifetime, mfaChallengeLifetime) + accessTokenLeeway,
+	})
+	if err != nil {
+		log.Fatalf("Could not load signing keys: %v", err)
+	}
+	defer keys.Close()
+
+	sweepDone := make(chan struct{})
+	defer close(sweepDone)
+	go sweepExpiredTokens(db, tokenSweepInterval, sweepDone)
+
+	mail, closeMailer, err := openMailer()
+	if err != nil {
+		log.Fatalf("Could not set up the mailer: %v", err)
+	}
+	defer closeMailer()
+
+	verifier := &emailVerifier{keys: keys, mail: mail, baseURL: publicURL, guard: newEmailVerificationGuard()}
+	guard := newLoginGuard()
+	resetGuard := newPasswordResetGuard()
+
+	// verified guards what users publish: chirps, edits and reports.
+	verified := func(next http.HandlerFunc) http.HandlerFunc {
+		if requireVerified {
+			return requireVerifiedEmail(db, next)
+		}
+		return next
 	}
 
 	serverMux := http.NewServeMux()
@@ -45,18 +198,49 @@ func main() {
 
 	serverMux.Handle("/app/", apiConfig.middlewareMetricsInc(http.StripPrefix("/app", fileServer)))
 	serverMux.HandleFunc("GET /api/healthz", handlerReadiness)
-	serverMux.HandleFunc("/api/reset", apiConfig.handlerReset)
-	serverMux.HandleFunc("GET /admin/metrics", apiConfig.handlerAdminMetrics)
-	serverMux.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) { handlerPostChirp(w, r, db) })
-	serverMux.HandleFunc("GET /api/chirps", func(w http.ResponseWriter, r *http.Request) { handlerGetChirp(w, r, db) })
-	serverMux.HandleFunc("GET /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) { handlerGetChirpByID(w, r, db) })
-	serverMux.HandleFunc("DELETE /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) { handlerDeleteChirp(w, r, db) })
-	serverMux.HandleFunc("POST /api/users", func(w http.ResponseWriter, r *http.Request) { handlerPostUser(w, r, db) })
-	serverMux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) { handlerLoginUser(w, r, db) })
-	serverMux.HandleFunc("PUT /api/users", func(w http.ResponseWriter, r *http.Request) { handlerUpdateUser(w, r, db) })
-	serverMux.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) { handlerRefreshToken(w, r, db) })
+	serverMux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) { handlerJWKS(w, r, keys) })
+	serverMux.HandleFunc("/api/reset", requireRole(db, keys, apiConfig.handlerReset, database.RoleAdmin))
+	serverMux.HandleFunc("GET /admin/metrics", requireRole(db, keys, apiConfig.handlerAdminMetrics, database.RoleAdmin))
+	serverMux.HandleFunc("POST /api/chirps", requireAuth(db, keys, verified(func(w http.ResponseWriter, r *http.Request) { handlerPostChirp(w, r, db, moderator) })))
+	serverMux.HandleFunc("GET /api/chirps", optionalAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetChirp(w, r, db) }))
+	serverMux.HandleFunc("GET /api/chirps/{chirpID}", optionalAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetChirpByID(w, r, db) }))
+	serverMux.HandleFunc("PUT /api/chirps/{chirpID}", requireAuth(db, keys, verified(func(w http.ResponseWriter, r *http.Request) { handlerPutChirp(w, r, db, moderator) })))
+	serverMux.HandleFunc("DELETE /api/chirps/{chirpID}", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerDeleteChirp(w, r, db) }))
+	serverMux.HandleFunc("GET /api/chirps/{chirpID}/revisions", optionalAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetChirpRevisions(w, r, db) }))
+	serverMux.HandleFunc("POST /api/users", func(w http.ResponseWriter, r *http.Request) { handlerPostUser(w, r, db, verifier) })
+	serverMux.HandleFunc("GET /api/users/{handle}", func(w http.ResponseWriter, r *http.Request) { handlerGetProfile(w, r, db) })
+	serverMux.HandleFunc("GET /api/users/verify", func(w http.ResponseWriter, r *http.Request) { handlerVerifyEmail(w, r, db, keys) })
+	serverMux.HandleFunc("POST /api/users/verify/resend", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerResendVerification(w, r, db, verifier) }))
+	serverMux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) { handlerLoginUser(w, r, db, keys, guard) })
+	serverMux.HandleFunc("POST /api/login/mfa", func(w http.ResponseWriter, r *http.Request) { handlerLoginMFA(w, r, db, keys, guard) })
+	serverMux.HandleFunc("GET /api/mfa", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetMFA(w, r, db) }))
+	serverMux.HandleFunc("POST /api/mfa/totp", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerEnrollTOTP(w, r, db, guard) }))
+	serverMux.HandleFunc("POST /api/mfa/totp/confirm", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerConfirmTOTP(w, r, db) }))
+	serverMux.HandleFunc("POST /api/mfa/disable", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerDisableMFA(w, r, db, guard) }))
+	serverMux.HandleFunc("POST /api/mfa/recovery-codes", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerRegenerateRecoveryCodes(w, r, db, guard) }))
+	serverMux.HandleFunc("POST /api/password-reset", func(w http.ResponseWriter, r *http.Request) { handlerRequestPasswordReset(w, r, db, mail, resetGuard) })
+	serverMux.HandleFunc("POST /api/password-reset/confirm", func(w http.ResponseWriter, r *http.Request) { handlerConfirmPasswordReset(w, r, db) })
+	serverMux.HandleFunc("PUT /api/users", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerUpdateUser(w, r, db, verifier, guard) }))
+	serverMux.HandleFunc("PATCH /api/users/me", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerPatchUser(w, r, db, verifier, guard) }))
+	serverMux.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) { handlerRefreshToken(w, r, db, keys) })
 	serverMux.HandleFunc("POST /api/revoke", func(w http.ResponseWriter, r *http.Request) { handlerRevokeToken(w, r, db) })
+	serverMux.HandleFunc("GET /api/sessions", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetSessions(w, r, db) }))
+	serverMux.HandleFunc("DELETE /api/sessions/{sessionID}", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerDeleteSession(w, r, db) }))
+	serverMux.HandleFunc("POST /api/sessions/revoke-all", requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerRevokeAllSessions(w, r, db) }))
 	serverMux.HandleFunc("POST /api/polka/webhooks", func(w http.ResponseWriter, r *http.Request) { handlerWebhooks(w, r, db) })
+	serverMux.HandleFunc("POST /api/chirps/{chirpID}/reports", requireAuth(db, keys, verified(func(w http.ResponseWriter, r *http.Request) { handlerPostReport(w, r, db) })))
+	serverMux.HandleFunc("GET /admin/reports", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetReports(w, r, db) }, database.RoleAdmin, database.RoleModerator))
+	serverMux.HandleFunc("POST /admin/reports/{reportID}/resolve", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerResolveReport(w, r, db) }, database.RoleAdmin, database.RoleModerator))
+	serverMux.HandleFunc("GET /admin/moderation/rules", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetModerationRules(w, r, moderator) }, database.RoleAdmin))
+	serverMux.HandleFunc("PUT /admin/moderation/rules", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerPutModerationRules(w, r, moderator) }, database.RoleAdmin))
+	serverMux.HandleFunc("POST /admin/moderation/rules", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerPostModerationRule(w, r, moderator) }, database.RoleAdmin))
+	serverMux.HandleFunc("DELETE /admin/moderation/rules/{word}", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerDeleteModerationRule(w, r, moderator) }, database.RoleAdmin))
+	serverMux.HandleFunc("GET /admin/moderation/flagged", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetFlaggedChirps(w, r, db) }, database.RoleAdmin, database.RoleModerator))
+	serverMux.HandleFunc("DELETE /admin/moderation/flagged/{chirpID}", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerClearChirpFlag(w, r, db) }, database.RoleAdmin, database.RoleModerator))
+	serverMux.HandleFunc("GET /admin/lockouts", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerGetLockouts(w, r, guard) }, database.RoleAdmin))
+	serverMux.HandleFunc("DELETE /admin/lockouts/accounts/{email}", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerClearAccountLockout(w, r, guard) }, database.RoleAdmin))
+	serverMux.HandleFunc("DELETE /admin/lockouts/ips/{ip}", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerClearIPLockout(w, r, guard) }, database.RoleAdmin))
+	serverMux.HandleFunc("PUT /admin/users/{userID}/roles", requireRole(db, keys, func(w http.ResponseWriter, r *http.Request) { handlerPutUserRoles(w, r, db) }, database.RoleAdmin))
 
 	server := http.Server{
 		Addr:    ":" + port,
@@ -64,3 +248,90 @@ func main() {
 	}
 	server.ListenAndServe()
 }
+
+// openMailer sets up the mailer selected by CHIRPY_MAILER. The returned
+// function releases it.
+func openMailer() (mailer.Mailer, func() error, error) {
+	switch driver := os.Getenv("CHIRPY_MAILER"); driver {
+	case "", "file":
+		fileMailer, err := mailer.NewFile(os.Getenv("CHIRPY_MAIL_FILE"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileMailer, fileMailer.Close, nil
+	case "smtp":
+		port := 0
+		if portSetting := os.Getenv("CHIRPY_SMTP_PORT"); portSetting != "" {
+			var err error
+			port, err = strconv.Atoi(portSetting)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid CHIRPY_SMTP_PORT: %w", err)
+			}
+		}
+
+		smtpMailer, err := mailer.NewSMTP(mailer.SMTPConfig{
+			Host:     os.Getenv("CHIRPY_SMTP_HOST"),
+			Port:     port,
+			Username: os.Getenv("CHIRPY_SMTP_USERNAME"),
+			Password: os.Getenv("CHIRPY_SMTP_PASSWORD"),
+			From:     os.Getenv("CHIRPY_MAIL_FROM"),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return smtpMailer, func() error { return nil }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown mailer %q", driver)
+	}
+}
+
+// passwordConfig applies the CHIRPY_PASSWORD_*, CHIRPY_ARGON2_* and
+// CHIRPY_BCRYPT_COST settings that are set to the default password settings.
+func passwordConfig() (database.PasswordConfig, error) {
+	config := database.DefaultPasswordConfig()
+	if algorithm := os.Getenv("CHIRPY_PASSWORD_HASH"); algorithm != "" {
+		config.Algorithm = algorithm
+	}
+
+	memory, iterations, threads := int(config.Argon2id.Memory), int(config.Argon2id.Time), int(config.Argon2id.Threads)
+	settings := map[string]*int{
+		"CHIRPY_ARGON2_MEMORY":        &memory,
+		"CHIRPY_ARGON2_TIME":          &iterations,
+		"CHIRPY_ARGON2_THREADS":       &threads,
+		"CHIRPY_BCRYPT_COST":          &config.BcryptCost,
+		"CHIRPY_PASSWORD_MIN_LENGTH":  &config.Policy.MinLength,
+		"CHIRPY_PASSWORD_MAX_LENGTH":  &config.Policy.MaxLength,
+		"CHIRPY_PASSWORD_MIN_CLASSES": &config.Policy.MinClasses,
+	}
+	for name, value := range settings {
+		setting := os.Getenv(name)
+		if setting == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(setting)
+		if err != nil || parsed < 0 {
+			return database.PasswordConfig{}, fmt.Errorf("invalid %s: %q", name, setting)
+		}
+		*value = parsed
+	}
+	if memory > math.MaxUint32 || iterations > math.MaxUint32 || threads > math.MaxUint8 {
+		return database.PasswordConfig{}, fmt.Errorf("the argon2id parameters are too large")
+	}
+	config.Argon2id = database.Argon2idParams{Memory: uint32(memory), Time: uint32(iterations), Threads: uint8(threads)}
+
+	return config, nil
+}
+
+// grantRole adds role to the user with email, keeping the roles they have.
+func grantRole(db database.Store, email, role string) (database.User, error) {
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	if user.HasRole(role) {
+		return user, nil
+	}
+
+	return db.SetUserRoles(user.ID, append(user.Roles, role))
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/keyset"
+	"github.com/Romasav/chirpy/totp"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// mfaChallengeLifetime is how long a user has to enter their code after
+	// entering their password.
+	mfaChallengeLifetime = 5 * time.Minute
+	// totpIssuer is the account issuer authenticator apps show.
+	totpIssuer = "Chirpy"
+)
+
+var errInvalidMFACode = errors.New("invalid verification code")
+
+// signMFAChallenge returns the token that proves a user entered their
+// password, to be exchanged for a session with their second factor.
+func signMFAChallenge(keys *keyset.Keyset, userID int) (string, error) {
+	return keys.Sign(&jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Subject:   strconv.Itoa(userID),
+		Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(mfaChallengeLifetime)),
+	})
+}
+
+// parseMFAChallenge validates a challenge token and returns its user.
+func parseMFAChallenge(tokenStr string, keys *keyset.Keyset) (int, error) {
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keys.Keyfunc,
+		jwt.WithValidMethods(keyset.Algorithms),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(mfaChallengeAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(accessTokenLeeway),
+	)
+	if err != nil || !token.Valid {
+		return 0, errInvalidToken
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, errInvalidToken
+	}
+
+	return userID, nil
+}
+
+// checkMFACode accepts a current TOTP code or one of the recovery codes of
+// user, and uses it up. It returns errInvalidMFACode for any other code.
+func checkMFACode(db database.Store, user database.User, code string) error {
+	if !user.MFA.Enabled() {
+		return errInvalidMFACode
+	}
+
+	if len(code) == totp.Digits {
+		step, valid := totp.Validate(user.MFA.TOTPSecret, code, time.Now())
+		if !valid {
+			return errInvalidMFACode
+		}
+		err := db.UseTOTPStep(user.ID, step)
+		if errors.Is(err, database.ErrTOTPCodeReused) {
+			return errInvalidMFACode
+		}
+		return err
+	}
+
+	err := db.UseRecoveryCode(user.ID, code)
+	if errors.Is(err, database.ErrNotFound) {
+		return errInvalidMFACode
+	}
+	return err
+}
+
+// reauthenticate checks the password of a user making a sensitive change, and
+// their second factor if they have one, and responds with an error if either
+// is wrong. Wrong guesses count as failed logins, so that a stolen access
+// token does not get around the login limits.
+func reauthenticate(w http.ResponseWriter, r *http.Request, db database.Store, guard *loginGuard, user database.User, password, code string) bool {
+	account, ip := accountKey(user.Email), clientIP(r)
+	if wait := guard.reserve(account, ip); wait > 0 {
+		respondWithLoginThrottled(w, wait)
+		return false
+	}
+
+	err := checkPassword(db, user, password)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Incorrect Password")
+		return false
+	}
+
+	if user.MFA.Enabled() {
+		err = checkMFACode(db, user, code)
+		if errors.Is(err, errInvalidMFACode) {
+			respondWithError(w, http.StatusUnauthorized, "Invalid verification code")
+			return false
+		}
+		if err != nil {
+			guard.release(account, ip)
+			respondWithDBError(w, err, "Failed to check the verification code")
+			return false
+		}
+	}
+
+	guard.succeed(account, ip)
+	return true
+}
+
+// handlerLoginMFA completes a login of a user with MFA enabled, exchanging the
+// challenge token from the password step and a code for a session.
+func handlerLoginMFA(w http.ResponseWriter, r *http.Request, db database.Store, keys *keyset.Keyset, guard *loginGuard) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	userID, err := parseMFAChallenge(request.MFAToken, keys)
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	user, err := db.GetUserByID(userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithAuthError(w, errInvalidToken)
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	// Wrong codes count against the account like wrong passwords, so that
+	// someone who knows the password cannot guess the code either.
+	account, ip := accountKey(user.Email), clientIP(r)
+	if wait := guard.reserve(account, ip); wait > 0 {
+		respondWithLoginThrottled(w, wait)
+		return
+	}
+
+	err = checkMFACode(db, user, request.Code)
+	if errors.Is(err, errInvalidMFACode) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid verification code")
+		return
+	}
+	if err != nil {
+		guard.release(account, ip)
+		respondWithDBError(w, err, "Failed to check the verification code")
+		return
+	}
+
+	guard.succeed(account, ip)
+	respondWithLogin(w, r, db, keys, user)
+}
+
+func handlerGetMFA(w http.ResponseWriter, r *http.Request, db database.Store) {
+	user, err := db.GetUserByID(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	respond := struct {
+		Enabled                bool `json:"enabled"`
+		RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+	}{
+		Enabled:                user.MFA.Enabled(),
+		RecoveryCodesRemaining: len(user.MFA.RecoveryCodeHashes),
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
+
+// handlerEnrollTOTP starts a TOTP enrollment. MFA stays off until the user
+// confirms it with a code from their authenticator app.
+func handlerEnrollTOTP(w http.ResponseWriter, r *http.Request, db database.Store, guard *loginGuard) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Password string `json:"password"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.GetUserByID(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if user.MFA.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if !reauthenticate(w, r, db, guard, user, request.Password, "") {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating a secret")
+		return
+	}
+
+	_, err = db.SetMFA(user.ID, database.MFA{PendingTOTPSecret: secret})
+	if err != nil {
+		respondWithDBError(w, err, "Failed to start the enrollment")
+		return
+	}
+
+	respond := struct {
+		Secret     string `json:"secret"`
+		OTPAuthURI string `json:"otpauth_uri"`
+	}{
+		Secret:     secret,
+		OTPAuthURI: totp.URI(totpIssuer, user.Email, secret),
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
+
+// handlerConfirmTOTP turns MFA on once the user enters a code for the pending
+// secret, and responds with their recovery codes. They are only shown once.
+func handlerConfirmTOTP(w http.ResponseWriter, r *http.Request, db database.Store) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Code string `json:"code"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.GetUserByID(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if user.MFA.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if user.MFA.PendingTOTPSecret == "" {
+		respondWithError(w, http.StatusConflict, "Start the enrollment first")
+		return
+	}
+
+	step, valid := totp.Validate(user.MFA.PendingTOTPSecret, request.Code, time.Now())
+	if !valid {
+		respondWithError(w, http.StatusBadRequest, "Invalid verification code")
+		return
+	}
+
+	codes, hashes, err := database.NewRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating recovery codes")
+		return
+	}
+
+	_, err = db.SetMFA(user.ID, database.MFA{
+		TOTPSecret:         user.MFA.PendingTOTPSecret,
+		LastTOTPStep:       step,
+		RecoveryCodeHashes: hashes,
+	})
+	if err != nil {
+		respondWithDBError(w, err, "Failed to enable two-factor authentication")
+		return
+	}
+
+	respond := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
+
+func handlerDisableMFA(w http.ResponseWriter, r *http.Request, db database.Store, guard *loginGuard) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.GetUserByID(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if !user.MFA.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+	if !reauthenticate(w, r, db, guard, user, request.Password, request.Code) {
+		return
+	}
+
+	_, err = db.SetMFA(user.ID, database.MFA{})
+	if err != nil {
+		respondWithDBError(w, err, "Failed to disable two-factor authentication")
+		return
+	}
+
+	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+}
+
+// handlerRegenerateRecoveryCodes replaces the recovery codes of a user, for
+// when they were lost or are running out.
+func handlerRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, db database.Store, guard *loginGuard) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.GetUserByID(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if !user.MFA.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is not enabled")
+		return
+	}
+	if !reauthenticate(w, r, db, guard, user, request.Password, request.Code) {
+		return
+	}
+
+	codes, hashes, err := database.NewRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error generating recovery codes")
+		return
+	}
+
+	// Reload the user, since checking the code changed their MFA state.
+	user, err = db.GetUserByID(user.ID)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	mfa := user.MFA
+	mfa.RecoveryCodeHashes = hashes
+	_, err = db.SetMFA(user.ID, mfa)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to replace the recovery codes")
+		return
+	}
+
+	respond := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
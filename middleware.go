@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/keyset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	tokenIssuer         = "chirpy"
+	accessTokenLifetime = time.Hour
+	// accessTokenLeeway absorbs clock skew when checking the expiry and
+	// issue time of access tokens.
+	accessTokenLeeway = 30 * time.Second
+)
+
+// Every kind of token is signed with the same keys and issuer, and the public
+// keys are published for other services. Each kind therefore carries its own
+// audience, which its parser requires, so that a token of one kind is never
+// accepted as another.
+const (
+	accessTokenAudience       = "chirpy-access"
+	emailVerificationAudience = "chirpy-email-verification"
+	mfaChallengeAudience      = "chirpy-mfa-challenge"
+)
+
+var (
+	errMissingAuthorization = errors.New("authorization header is missing")
+	errInvalidToken         = errors.New("invalid or expired token")
+)
+
+type contextKey int
+
+const (
+	userIDContextKey contextKey = iota
+	sessionIDContextKey
+)
+
+// accessTokenClaims are the claims of an access token. SessionID names the
+// session (refresh token family) the token was issued for.
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID string `json:"sid"`
+}
+
+// requireAuth only lets requests through that carry a valid access token of a
+// session that has not been revoked, and stores the IDs of the authenticated
+// user and session in the request context.
+func requireAuth(db database.Store, keys *keyset.Keyset, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, sessionID, err := parseAccessToken(r, keys)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		_, err = db.GetSession(userID, sessionID)
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithAuthError(w, errInvalidToken)
+			return
+		}
+		if err != nil {
+			respondWithDBError(w, err, "Failed to load session")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDContextKey, userID)
+		ctx = context.WithValue(ctx, sessionIDContextKey, sessionID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// optionalAuth is requireAuth for endpoints that also serve anonymous
+// requests. A request without an Authorization header passes through as
+// anonymous; one with an invalid token is still refused.
+func optionalAuth(db database.Store, keys *keyset.Keyset, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r)
+			return
+		}
+
+		requireAuth(db, keys, next)(w, r)
+	}
+}
+
+// requireRole only lets requests through from a logged-in user with at least
+// one of roles. The roles are read from the database on every request rather
+// than from the access token, so taking a role away takes effect immediately.
+func requireRole(db database.Store, keys *keyset.Keyset, next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return requireAuth(db, keys, func(w http.ResponseWriter, r *http.Request) {
+		user, err := db.GetUserByID(requestUserID(r))
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithAuthError(w, errInvalidToken)
+			return
+		}
+		if err != nil {
+			respondWithDBError(w, err, "Failed to load user")
+			return
+		}
+
+		if !user.HasRole(roles...) {
+			respondWithError(w, http.StatusForbidden, "You do not have permission to do this")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// requireVerifiedEmail only lets requests through from a user who has
+// verified their email address. It must be served behind requireAuth.
+func requireVerifiedEmail(db database.Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := db.GetUserByID(requestUserID(r))
+		if err != nil {
+			respondWithDBError(w, err, "Failed to load user")
+			return
+		}
+
+		if !user.Verified {
+			respondWithError(w, http.StatusForbidden, "Verify your email address first")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// userIDFromContext returns the user authenticated by requireAuth or
+// optionalAuth, if any.
+func userIDFromContext(ctx context.Context) (int, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(int)
+	return userID, ok
+}
+
+// requestUserID returns the authenticated user of a request served behind
+// requireAuth.
+func requestUserID(r *http.Request) int {
+	userID, _ := userIDFromContext(r.Context())
+	return userID
+}
+
+// requestSessionID returns the session of a request served behind
+// requireAuth.
+func requestSessionID(r *http.Request) int {
+	sessionID, _ := r.Context().Value(sessionIDContextKey).(int)
+	return sessionID
+}
+
+// isModeratorRequest reports whether a request served behind optionalAuth is
+// made by an admin or a moderator.
+func isModeratorRequest(r *http.Request, db database.Store) bool {
+	userID, ok := userIDFromContext(r.Context())
+	if !ok {
+		return false
+	}
+
+	user, err := db.GetUserByID(userID)
+	return err == nil && user.HasRole(database.RoleAdmin, database.RoleModerator)
+}
+
+// parseAccessToken validates the Bearer token of r against keys and returns
+// its subject and session.
+func parseAccessToken(r *http.Request, keys *keyset.Keyset) (int, int, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return 0, 0, errMissingAuthorization
+	}
+
+	tokenStr, found := strings.CutPrefix(authHeader, "Bearer ")
+	if !found {
+		return 0, 0, errInvalidToken
+	}
+
+	claims := &accessTokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keys.Keyfunc,
+		jwt.WithValidMethods(keyset.Algorithms),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(accessTokenAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(accessTokenLeeway),
+	)
+	if err != nil || !token.Valid {
+		return 0, 0, errInvalidToken
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, 0, errInvalidToken
+	}
+
+	// Tokens issued before sessions existed have no sid; they are refused
+	// like revoked ones and the client refreshes them.
+	sessionID, err := strconv.Atoi(claims.SessionID)
+	if err != nil {
+		return 0, 0, errInvalidToken
+	}
+
+	return userId, sessionID, nil
+}
+
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errMissingAuthorization) {
+		respondWithError(w, http.StatusUnauthorized, "Authorization header is required")
+		return
+	}
+	respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+}
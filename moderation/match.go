@@ -0,0 +1,181 @@
+package moderation
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const mask = "****"
+
+// Result is the outcome of checking a chirp.
+type Result struct {
+	// Body is the chirp with every masked word replaced.
+	Body     string
+	Rejected bool
+	Flagged  bool
+	// Matches holds the rule of every matched word, in the order found.
+	Matches []Rule
+}
+
+// Check matches each word of body against the rules. Words are compared by
+// skeleton, so case, accents, punctuation around or inside the word and
+// look-alike characters ("kerfuffle!", "KÉRFUFFLE", "k3rfuffle", a Cyrillic
+// "е") do not let a word slip through.
+func (engine *Engine) Check(body string) Result {
+	engine.mux.RLock()
+	defer engine.mux.RUnlock()
+
+	result := Result{}
+	var checked strings.Builder
+	last := 0
+	for _, token := range splitWords(body) {
+		word, rule, matched := engine.match(body, token)
+		if !matched {
+			continue
+		}
+		checked.WriteString(body[last:word.start])
+		last = word.end
+
+		result.Matches = append(result.Matches, rule)
+		switch rule.Action {
+		case ActionMask:
+			checked.WriteString(mask)
+		case ActionReject:
+			result.Rejected = true
+			checked.WriteString(body[word.start:word.end])
+		case ActionFlag:
+			result.Flagged = true
+			checked.WriteString(body[word.start:word.end])
+		}
+	}
+	checked.WriteString(body[last:])
+
+	result.Body = checked.String()
+	return result
+}
+
+// match returns the rule token matches and the part of body that matched.
+// The token is tried with the digits and symbols that imitate letters trimmed
+// from its ends first, so "kerfuffle$" and "@kerfuffle" match, and then
+// without, so that trimming cannot hide a word that starts or ends with one.
+func (engine *Engine) match(body string, token token) (span, Rule, bool) {
+	for _, word := range []span{token.trimmed, token.whole} {
+		rule, matched := engine.bySkel[skeleton(body[word.start:word.end])]
+		if matched {
+			return word, rule, true
+		}
+	}
+	return span{}, Rule{}, false
+}
+
+type span struct {
+	start, end int
+}
+
+// token is a run of text between whitespace. whole leaves out the punctuation
+// at either end, so masking "Kerfuffle!" leaves "****!"; trimmed also leaves
+// out the look-alike digits and symbols there.
+type token struct {
+	whole, trimmed span
+}
+
+// splitWords returns the tokens of s.
+func splitWords(s string) []token {
+	tokens := []token{}
+	start := -1
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				tokens = appendToken(tokens, s, start, i)
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = appendToken(tokens, s, start, len(s))
+	}
+	return tokens
+}
+
+func appendToken(tokens []token, s string, start, end int) []token {
+	whole, ok := trim(s, span{start: start, end: end}, isPunctuation)
+	if !ok {
+		return tokens
+	}
+	trimmed, ok := trim(s, whole, isEdge)
+	if !ok {
+		trimmed = whole
+	}
+	return append(tokens, token{whole: whole, trimmed: trimmed})
+}
+
+// trim returns the part of s in text without the runes at either end that
+// drop reports, and false if nothing is left.
+func trim(s string, text span, drop func(rune) bool) (span, bool) {
+	token := s[text.start:text.end]
+	trimmedLeft := strings.TrimLeftFunc(token, drop)
+	trimmed := strings.TrimRightFunc(trimmedLeft, drop)
+	if trimmed == "" {
+		return span{}, false
+	}
+
+	start := text.start + len(token) - len(trimmedLeft)
+	return span{start: start, end: start + len(trimmed)}, true
+}
+
+func isPunctuation(r rune) bool {
+	if _, confusable := confusables[r]; confusable {
+		return false
+	}
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+}
+
+// isEdge reports whether r is trimmed from the ends of a token before it is
+// matched: punctuation, or a digit or symbol that imitates a letter.
+func isEdge(r rune) bool {
+	_, confusable := confusables[r]
+	return isPunctuation(r) || (confusable && !unicode.IsLetter(r))
+}
+
+// confusables maps characters that are commonly swapped in to dodge filters
+// to the letter they imitate. Letters that look alike map to one of them, so
+// "l", "1" and "i" are the same to the matcher.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b',
+	'@': 'a', '$': 's', 'l': 'i',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o',
+	'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j',
+	'ѕ': 's', 'ԁ': 'd', 'ӏ': 'i',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// skeleton reduces word to the form rules are compared in: compatibility
+// decomposed, case-folded, without accents, with confusable characters
+// replaced and everything but letters and digits dropped.
+func skeleton(word string) string {
+	folded := cases.Fold().String(norm.NFKD.String(word))
+
+	var skel strings.Builder
+	for _, r := range folded {
+		if unicode.IsMark(r) {
+			continue
+		}
+		if replacement, confusable := confusables[r]; confusable {
+			r = replacement
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			skel.WriteRune(r)
+		}
+	}
+	return skel.String()
+}
@@ -0,0 +1,47 @@
+package moderation
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestCheck masks words written to dodge the rules: with punctuation or
+// look-alike characters around or inside them, in other cases or with
+// accents.
+func TestCheck(t *testing.T) {
+	engine, err := NewEngine(filepath.Join(t.TempDir(), "moderation.json"))
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	defer engine.Close()
+
+	err = engine.AddRule(Rule{Word: "ideal", Action: ActionMask})
+	if err != nil {
+		t.Fatalf("AddRule: %v", err)
+	}
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"what a kerfuffle", "what a ****"},
+		{"Kerfuffle!", "****!"},
+		{"(fornax)", "(****)"},
+		{"kerfuffle$", "****$"},
+		{"kerfuffle1", "****1"},
+		{"@kerfuffle", "@****"},
+		{"KÉRFUFFLE", "****"},
+		{"k3rfuffle", "****"},
+		{"kеrfuffle", "****"}, // Cyrillic е
+		{"sh.arbert", "****"},
+		{"1deal", "****"},
+		{"kerfuffles", "kerfuffles"},
+		{"nothing to see", "nothing to see"},
+	}
+	for _, test := range tests {
+		result := engine.Check(test.body)
+		if result.Body != test.want {
+			t.Errorf("Check(%q) = %q, want %q", test.body, result.Body, test.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package moderation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Romasav/chirpy/atomicfile"
+)
+
+// Action is what happens to a chirp containing the word of a rule.
+type Action string
+
+const (
+	// ActionMask replaces the word with "****".
+	ActionMask Action = "mask"
+	// ActionReject refuses the whole chirp.
+	ActionReject Action = "reject"
+	// ActionFlag keeps the chirp as written but marks it for review.
+	ActionFlag Action = "flag"
+)
+
+type Rule struct {
+	Word   string `json:"word"`
+	Action Action `json:"action"`
+}
+
+var (
+	ErrInvalidRule  = errors.New("invalid moderation rule")
+	ErrRuleNotFound = errors.New("moderation rule not found")
+)
+
+// DefaultRules are used while no config file exists.
+var DefaultRules = []Rule{
+	{Word: "kerfuffle", Action: ActionMask},
+	{Word: "sharbert", Action: ActionMask},
+	{Word: "fornax", Action: ActionMask},
+}
+
+const reloadInterval = 2 * time.Second
+
+type config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Engine checks chirps against a word list kept in a JSON config file. The
+// file is polled and reloaded when it changes, and the admin API edits it
+// through SetRules, AddRule and RemoveRule.
+type Engine struct {
+	path      string
+	mux       sync.RWMutex
+	rules     []Rule
+	bySkel    map[string]Rule
+	modTime   int64
+	size      int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewEngine(path string) (*Engine, error) {
+	engine := Engine{
+		path: path,
+		done: make(chan struct{}),
+	}
+
+	err := engine.load()
+	if err != nil {
+		return nil, err
+	}
+
+	go engine.watch()
+
+	return &engine, nil
+}
+
+func (engine *Engine) Close() error {
+	engine.closeOnce.Do(func() {
+		close(engine.done)
+	})
+	return nil
+}
+
+// Rules returns the active rules in the order they are stored.
+func (engine *Engine) Rules() []Rule {
+	engine.mux.RLock()
+	defer engine.mux.RUnlock()
+
+	rules := make([]Rule, len(engine.rules))
+	copy(rules, engine.rules)
+	return rules
+}
+
+// SetRules replaces every rule and writes the new list to the config file.
+func (engine *Engine) SetRules(rules []Rule) error {
+	engine.mux.Lock()
+	defer engine.mux.Unlock()
+
+	return engine.saveLocked(rules)
+}
+
+// AddRule adds rule, replacing an existing rule for the same word.
+func (engine *Engine) AddRule(rule Rule) error {
+	engine.mux.Lock()
+	defer engine.mux.Unlock()
+
+	rules := make([]Rule, 0, len(engine.rules)+1)
+	replaced := false
+	for _, existing := range engine.rules {
+		if skeleton(existing.Word) == skeleton(rule.Word) {
+			rules = append(rules, rule)
+			replaced = true
+			continue
+		}
+		rules = append(rules, existing)
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	return engine.saveLocked(rules)
+}
+
+// RemoveRule removes the rule for word, which is matched the same way chirps
+// are.
+func (engine *Engine) RemoveRule(word string) error {
+	engine.mux.Lock()
+	defer engine.mux.Unlock()
+
+	rules := make([]Rule, 0, len(engine.rules))
+	for _, existing := range engine.rules {
+		if skeleton(existing.Word) != skeleton(word) {
+			rules = append(rules, existing)
+		}
+	}
+	if len(rules) == len(engine.rules) {
+		return fmt.Errorf("%w: %q", ErrRuleNotFound, word)
+	}
+
+	return engine.saveLocked(rules)
+}
+
+// compileRules validates rules and indexes them by skeleton.
+func compileRules(rules []Rule) (map[string]Rule, error) {
+	bySkel := map[string]Rule{}
+	for _, rule := range rules {
+		switch rule.Action {
+		case ActionMask, ActionReject, ActionFlag:
+		default:
+			return nil, fmt.Errorf("%w: %q has unknown action %q", ErrInvalidRule, rule.Word, rule.Action)
+		}
+
+		skel := skeleton(rule.Word)
+		if skel == "" {
+			return nil, fmt.Errorf("%w: %q has no letters or digits", ErrInvalidRule, rule.Word)
+		}
+		if len(splitWords(rule.Word)) != 1 {
+			return nil, fmt.Errorf("%w: %q must be a single word", ErrInvalidRule, rule.Word)
+		}
+		if existing, exists := bySkel[skel]; exists {
+			return nil, fmt.Errorf("%w: %q and %q match the same words", ErrInvalidRule, existing.Word, rule.Word)
+		}
+		bySkel[skel] = rule
+	}
+	return bySkel, nil
+}
+
+// load reads the config file, falling back to DefaultRules if it does not
+// exist.
+func (engine *Engine) load() error {
+	engine.mux.Lock()
+	defer engine.mux.Unlock()
+
+	info, err := os.Stat(engine.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return engine.applyLocked(DefaultRules, 0, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(engine.path)
+	if err != nil {
+		return err
+	}
+
+	var cfg config
+	err = json.Unmarshal(data, &cfg)
+	if err == nil {
+		err = engine.applyLocked(cfg.Rules, info.ModTime().UnixNano(), info.Size())
+	}
+	if err != nil {
+		// Remember the broken file so it is reported once rather than on
+		// every poll.
+		engine.modTime = info.ModTime().UnixNano()
+		engine.size = info.Size()
+		return fmt.Errorf("moderation config %s: %w", engine.path, err)
+	}
+	return nil
+}
+
+func (engine *Engine) applyLocked(rules []Rule, modTime, size int64) error {
+	bySkel, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+
+	engine.rules = append([]Rule{}, rules...)
+	engine.bySkel = bySkel
+	engine.modTime = modTime
+	engine.size = size
+	return nil
+}
+
+// saveLocked writes rules to the config file and makes them active. The file
+// is replaced atomically so a reload never sees it half-written.
+func (engine *Engine) saveLocked(rules []Rule) error {
+	_, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config{Rules: rules}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(engine.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	err = atomicfile.WriteFile(engine.path, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(engine.path)
+	if err != nil {
+		return err
+	}
+
+	return engine.applyLocked(rules, info.ModTime().UnixNano(), info.Size())
+}
+
+func (engine *Engine) changed() bool {
+	engine.mux.RLock()
+	defer engine.mux.RUnlock()
+
+	info, err := os.Stat(engine.path)
+	if err != nil {
+		// A deleted file keeps the rules that were last loaded.
+		return false
+	}
+	return info.ModTime().UnixNano() != engine.modTime || info.Size() != engine.size
+}
+
+func (engine *Engine) watch() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-engine.done:
+			return
+		case <-ticker.C:
+			if !engine.changed() {
+				continue
+			}
+			err := engine.load()
+			if err != nil {
+				log.Printf("Keeping the previous moderation rules: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/moderation"
+)
+
+func handlerGetModerationRules(w http.ResponseWriter, r *http.Request, moderator *moderation.Engine) {
+	respondWithJSON(w, moderator.Rules(), http.StatusOK)
+}
+
+func handlerPutModerationRules(w http.ResponseWriter, r *http.Request, moderator *moderation.Engine) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Rules []moderation.Rule `json:"rules"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	err = moderator.SetRules(request.Rules)
+	if err != nil {
+		respondWithModerationError(w, err, "Failed to save moderation rules")
+		return
+	}
+
+	respondWithJSON(w, moderator.Rules(), http.StatusOK)
+}
+
+func handlerPostModerationRule(w http.ResponseWriter, r *http.Request, moderator *moderation.Engine) {
+	decoder := json.NewDecoder(r.Body)
+	rule := moderation.Rule{}
+	err := decoder.Decode(&rule)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	err = moderator.AddRule(rule)
+	if err != nil {
+		respondWithModerationError(w, err, "Failed to save moderation rules")
+		return
+	}
+
+	respondWithJSON(w, moderator.Rules(), http.StatusOK)
+}
+
+func handlerDeleteModerationRule(w http.ResponseWriter, r *http.Request, moderator *moderation.Engine) {
+	err := moderator.RemoveRule(r.PathValue("word"))
+	if err != nil {
+		respondWithModerationError(w, err, "Failed to save moderation rules")
+		return
+	}
+
+	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+}
+
+// handlerGetFlaggedChirps lists the review queue. It includes hidden chirps,
+// so that a chirp hidden after a report can still be reviewed.
+func handlerGetFlaggedChirps(w http.ResponseWriter, r *http.Request, db database.Store) {
+	query := database.ChirpQuery{
+		FlaggedOnly:   true,
+		IncludeHidden: true,
+		Cursor:        r.URL.Query().Get("cursor"),
+	}
+
+	limitString := r.URL.Query().Get("limit")
+	if limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 || limit > database.MaxChirpPageSize {
+			errorMessage := fmt.Sprintf("limit must be between 1 and %d", database.MaxChirpPageSize)
+			respondWithError(w, http.StatusBadRequest, errorMessage)
+			return
+		}
+		query.Limit = limit
+	}
+
+	page, err := db.ListChirps(query)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load flagged chirps")
+		return
+	}
+
+	if page.NextCursor != "" {
+		nextQuery := r.URL.Query()
+		nextQuery.Set("cursor", page.NextCursor)
+		nextURL := url.URL{Path: r.URL.Path, RawQuery: nextQuery.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.String()))
+	}
+
+	respondWithJSON(w, page.Chirps, http.StatusOK)
+}
+
+// handlerClearChirpFlag approves a flagged chirp after review.
+func handlerClearChirpFlag(w http.ResponseWriter, r *http.Request, db database.Store) {
+	chirpIDStr := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+
+	chirp, err := db.SetChirpFlagged(chirpID, false)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to clear chirp flag")
+		return
+	}
+
+	respondWithJSON(w, chirp, http.StatusOK)
+}
+
+func respondWithModerationError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, moderation.ErrInvalidRule):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, moderation.ErrRuleNotFound):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	default:
+		respondWithDBError(w, err, msg)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+	"github.com/Romasav/chirpy/mailer"
+)
+
+// handlerRequestPasswordReset emails a reset token to the user with the given
+// email. It answers the same, and as fast, whether or not the email belongs
+// to a user, so it cannot be used to find out who has an account.
+func handlerRequestPasswordReset(w http.ResponseWriter, r *http.Request, db database.Store, mail mailer.Mailer, guard *passwordResetGuard) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Email string `json:"email"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if wait := guard.reserve(request.Email, clientIP(r)); wait > 0 {
+		respondWithThrottled(w, wait, "Too many password reset requests, try again later")
+		return
+	}
+
+	// Looking the user up and creating the token take longer for emails
+	// that belong to an account, so they happen after responding.
+	go sendPasswordReset(db, mail, request.Email)
+
+	respond := struct {
+		Message string `json:"message"`
+	}{
+		Message: "If the email belongs to an account, a password reset token has been sent to it",
+	}
+
+	respondWithJSON(w, respond, http.StatusAccepted)
+}
+
+// sendPasswordReset emails a reset token to the user with email, if there is
+// one.
+func sendPasswordReset(db database.Store, mail mailer.Mailer, email string) {
+	user, err := db.GetUserByEmail(email)
+	if errors.Is(err, database.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("Could not load the user asking for a password reset: %v", err)
+		return
+	}
+
+	resetToken, err := db.CreatePasswordResetToken(user.ID)
+	if err != nil {
+		log.Printf("Could not create a password reset token for user %d: %v", user.ID, err)
+		return
+	}
+
+	err = mail.Send(passwordResetMessage(user.Email, resetToken))
+	if err != nil {
+		log.Printf("Could not send the password reset email to user %d: %v", user.ID, err)
+	}
+}
+
+func passwordResetMessage(email string, resetToken database.PasswordResetToken) mailer.Message {
+	validFor := int(time.Until(resetToken.ExpiresAt).Round(time.Minute).Minutes())
+	return mailer.Message{
+		To:      email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of your Chirpy account.\n\n"+
+				"To choose a new password, send this token to /api/password-reset/confirm within %d minutes:\n\n"+
+				"%s\n\n"+
+				"If it was not you, ignore this email; your password stays the same.\n",
+			validFor, resetToken.Token,
+		),
+	}
+}
+
+// handlerConfirmPasswordReset sets a new password with a reset token and logs
+// the user out everywhere.
+func handlerConfirmPasswordReset(w http.ResponseWriter, r *http.Request, db database.Store) {
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	err := decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	_, err = db.ResetPassword(request.Token, request.Password)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, http.StatusBadRequest, "The password reset token is invalid or has expired")
+		return
+	}
+	if err != nil {
+		respondWithDBError(w, err, "Failed to reset password")
+		return
+	}
+
+	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+)
+
+// profileResponse is what anyone can see of a user; it leaves out the email.
+type profileResponse struct {
+	ID          int       `json:"id"`
+	Handle      string    `json:"handle"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	ChirpCount  int       `json:"chirp_count"`
+}
+
+func newProfileResponse(profile database.Profile) profileResponse {
+	return profileResponse{
+		ID:          profile.UserID,
+		Handle:      profile.Handle,
+		DisplayName: profile.DisplayName,
+		Bio:         profile.Bio,
+		AvatarURL:   profile.AvatarURL,
+		CreatedAt:   profile.CreatedAt,
+		ChirpCount:  profile.ChirpCount,
+	}
+}
+
+// chirpResponse is what users see of a chirp, with the profile of its author
+// if the request asked for it. Whether the chirp was flagged or hidden is only
+// shown to admins and moderators.
+type chirpResponse struct {
+	ID        int              `json:"id"`
+	Body      string           `json:"body"`
+	AuthorID  int              `json:"author_id"`
+	Edited    bool             `json:"edited"`
+	Flagged   *bool            `json:"flagged,omitempty"`
+	Hidden    *bool            `json:"hidden,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Author    *profileResponse `json:"author,omitempty"`
+}
+
+func newChirpResponse(chirp database.Chirp, showModeration bool) chirpResponse {
+	response := chirpResponse{
+		ID:        chirp.ID,
+		Body:      chirp.Body,
+		AuthorID:  chirp.AuthorID,
+		Edited:    chirp.Edited,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+	}
+	if showModeration {
+		response.Flagged = &chirp.Flagged
+		response.Hidden = &chirp.Hidden
+	}
+	return response
+}
+
+func newChirpResponses(chirps []database.Chirp, showModeration bool) []chirpResponse {
+	responses := make([]chirpResponse, 0, len(chirps))
+	for _, chirp := range chirps {
+		responses = append(responses, newChirpResponse(chirp, showModeration))
+	}
+	return responses
+}
+
+// handlerGetProfile looks a user up by handle, with or without the "@".
+func handlerGetProfile(w http.ResponseWriter, r *http.Request, db database.Store) {
+	profile, err := db.GetProfileByHandle(r.PathValue("handle"))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load profile")
+		return
+	}
+
+	respondWithJSON(w, newProfileResponse(profile), http.StatusOK)
+}
+
+// parseExpandAuthor reports whether the request asks for expand=author, and
+// responds with an error if expand is anything else.
+func parseExpandAuthor(w http.ResponseWriter, r *http.Request) (expandAuthor, ok bool) {
+	switch r.URL.Query().Get("expand") {
+	case "":
+		return false, true
+	case "author":
+		return true, true
+	default:
+		respondWithError(w, http.StatusBadRequest, "expand must be author")
+		return false, false
+	}
+}
+
+// withAuthors adds the profiles of their authors to chirps, loaded together
+// so a page costs one lookup.
+func withAuthors(db database.Store, chirps []chirpResponse) error {
+	authorIDs := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		authorIDs = append(authorIDs, chirp.AuthorID)
+	}
+
+	profiles, err := db.GetProfiles(authorIDs)
+	if err != nil {
+		return err
+	}
+
+	for i, chirp := range chirps {
+		if profile, exists := profiles[chirp.AuthorID]; exists {
+			author := newProfileResponse(profile)
+			chirps[i].Author = &author
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Romasav/chirpy/database"
+)
+
+func handlerPostReport(w http.ResponseWriter, r *http.Request, db database.Store) {
+	userId := requestUserID(r)
+
+	chirpIDStr := r.PathValue("chirpID")
+	chirpID, err := strconv.Atoi(chirpIDStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+	}{}
+	err = decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, err := db.GetUserByID(userId)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load user")
+		return
+	}
+
+	if user.Suspended {
+		respondWithError(w, http.StatusForbidden, "Your account is suspended")
+		return
+	}
+
+	chirp, err := db.GetChirpByID(chirpID)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load chirp")
+		return
+	}
+
+	if chirp.Hidden {
+		respondWithHiddenChirp(w, chirpID)
+		return
+	}
+
+	report, err := db.CreateReport(chirpID, userId, request.Reason, request.Details)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to create report")
+		return
+	}
+
+	reportRespond := struct {
+		ID      int    `json:"id"`
+		ChirpID int    `json:"chirp_id"`
+		Reason  string `json:"reason"`
+		Details string `json:"details"`
+		Status  string `json:"status"`
+	}{
+		ID:      report.ID,
+		ChirpID: report.ChirpID,
+		Reason:  report.Reason,
+		Details: report.Details,
+		Status:  report.Status,
+	}
+
+	respondWithJSON(w, reportRespond, http.StatusCreated)
+}
+
+func handlerGetReports(w http.ResponseWriter, r *http.Request, db database.Store) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = database.ReportStatusOpen
+	case "all":
+		status = ""
+	}
+
+	reports, err := db.ListReports(status)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load reports")
+		return
+	}
+
+	respondWithJSON(w, reports, http.StatusOK)
+}
+
+func handlerResolveReport(w http.ResponseWriter, r *http.Request, db database.Store) {
+	reportIDStr := r.PathValue("reportID")
+	reportID, err := strconv.Atoi(reportIDStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid report ID")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	request := struct {
+		Action string `json:"action"`
+	}{}
+	err = decoder.Decode(&request)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	report, err := db.ResolveReport(reportID, request.Action)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to resolve report")
+		return
+	}
+
+	respondWithJSON(w, report, http.StatusOK)
+}
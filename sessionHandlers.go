@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+)
+
+type sessionResponse struct {
+	ID         int       `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	// Current marks the session the request was made with.
+	Current bool `json:"current"`
+}
+
+func handlerGetSessions(w http.ResponseWriter, r *http.Request, db database.Store) {
+	sessions, err := db.ListSessions(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to load sessions")
+		return
+	}
+
+	currentSessionID := requestSessionID(r)
+	sessionsRespond := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		sessionsRespond = append(sessionsRespond, sessionResponse{
+			ID:         session.ID,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			Current:    session.ID == currentSessionID,
+		})
+	}
+
+	respondWithJSON(w, sessionsRespond, http.StatusOK)
+}
+
+func handlerDeleteSession(w http.ResponseWriter, r *http.Request, db database.Store) {
+	sessionIDStr := r.PathValue("sessionID")
+	sessionID, err := strconv.Atoi(sessionIDStr)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	err = db.DeleteSession(requestUserID(r), sessionID)
+	if err != nil {
+		respondWithDBError(w, err, "Failed to revoke session")
+		return
+	}
+
+	respondWithJSON(w, struct{}{}, http.StatusNoContent)
+}
+
+// handlerRevokeAllSessions logs the user out everywhere, including the
+// session the request was made with.
+func handlerRevokeAllSessions(w http.ResponseWriter, r *http.Request, db database.Store) {
+	revoked, err := db.DeleteUserSessions(requestUserID(r))
+	if err != nil {
+		respondWithDBError(w, err, "Failed to revoke sessions")
+		return
+	}
+
+	respond := struct {
+		Revoked int `json:"revoked"`
+	}{
+		Revoked: revoked,
+	}
+
+	respondWithJSON(w, respond, http.StatusOK)
+}
+
+// clientIP returns the address the request came from. Forwarding headers are
+// ignored because they are set by the client unless a trusted proxy
+// overwrites them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
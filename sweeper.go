@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/Romasav/chirpy/database"
+)
+
+// sweepExpiredTokens deletes expired refresh and password reset tokens now
+// and then every interval, until done is closed. Expired tokens are useless,
+// but a rotated refresh token is kept until it expires so that its reuse is
+// still detected.
+func sweepExpiredTokens(db database.Store, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := db.DeleteExpiredRefreshTokens()
+		if err != nil {
+			log.Printf("Could not delete expired refresh tokens: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired refresh tokens", deleted)
+		}
+
+		deleted, err = db.DeleteExpiredPasswordResetTokens()
+		if err != nil {
+			log.Printf("Could not delete expired password reset tokens: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired password reset tokens", deleted)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
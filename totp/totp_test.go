@@ -0,0 +1,117 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeRFC6238 checks the SHA-1 test vectors of RFC 6238, appendix B. The
+// RFC gives eight digits; six-digit codes are their last six.
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		code, err := Code(rfcSecret, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatalf("Code: %v", err)
+		}
+		if code != test.want {
+			t.Errorf("Code at %d = %s, want %s", test.unix, code, test.want)
+		}
+
+		step, valid := Validate(rfcSecret, test.want, time.Unix(test.unix, 0))
+		if !valid || step != test.unix/30 {
+			t.Errorf("Validate(%s) at %d = %d, %v, want %d, true", test.want, test.unix, step, valid, test.unix/30)
+		}
+	}
+}
+
+// TestValidateSkew accepts codes up to Skew steps away, and returns the step
+// each code belongs to so that callers can refuse it the second time.
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / 30
+
+	tests := []struct {
+		name      string
+		codeAt    time.Time
+		wantValid bool
+		wantStep  int64
+	}{
+		{"current step", now, true, current},
+		{"previous step", now.Add(-Period), true, current - 1},
+		{"next step", now.Add(Period), true, current + 1},
+		{"two steps old", now.Add(-2 * Period), false, 0},
+		{"two steps ahead", now.Add(2 * Period), false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, test.codeAt)
+			if err != nil {
+				t.Fatalf("Code: %v", err)
+			}
+
+			step, valid := Validate(rfcSecret, code, now)
+			if valid != test.wantValid || step != test.wantStep {
+				t.Errorf("Validate = %d, %v, want %d, %v", step, valid, test.wantStep, test.wantValid)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := []struct {
+		name, secret, code string
+	}{
+		{"wrong code", rfcSecret, "123456"},
+		{"too short", rfcSecret, "28708"},
+		{"too long", rfcSecret, "2870820"},
+		{"eight digits", rfcSecret, "94287082"},
+		{"invalid secret", "not base32!", "287082"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, valid := Validate(test.secret, test.code, now); valid {
+				t.Errorf("Validate(%q, %q) accepted the code", test.secret, test.code)
+			}
+		})
+	}
+}
+
+// TestGenerateSecret returns secrets that codes can be made and checked with.
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	if secret == other {
+		t.Errorf("GenerateSecret returned %s twice", secret)
+	}
+
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatalf("Code: %v", err)
+	}
+	if _, valid := Validate(secret, code, now); !valid {
+		t.Errorf("Validate refused the code %s of a generated secret", code)
+	}
+}
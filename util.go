@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+
+	"github.com/Romasav/chirpy/database"
 )
 
 func respondWithJSON(w http.ResponseWriter, data interface{}, statusCode int) {
@@ -17,6 +22,33 @@ func respondWithJSON(w http.ResponseWriter, data interface{}, statusCode int) {
 	w.Write(jsonData)
 }
 
+// respondWithDBError picks the status for an error returned by the database
+// package. Anything that is not a known error kind is logged and reported as
+// a 500 with msg, so storage details never reach the client.
+func respondWithDBError(w http.ResponseWriter, err error, msg string) {
+	var validationErr *database.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		errorJson := map[string]string{"error": validationErr.Error(), "field": validationErr.Field}
+		respondWithJSON(w, errorJson, http.StatusBadRequest)
+	case errors.Is(err, database.ErrValidation):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, database.ErrNotFound):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, database.ErrConflict):
+		respondWithError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("%s: %v", msg, err)
+		respondWithError(w, http.StatusInternalServerError, msg)
+	}
+}
+
+// respondWithHiddenChirp answers like the chirp does not exist, so hidden
+// chirps cannot be told apart from deleted ones.
+func respondWithHiddenChirp(w http.ResponseWriter, chirpID int) {
+	respondWithError(w, http.StatusNotFound, fmt.Sprintf("the chirp with id = %v was not found", chirpID))
+}
+
 func respondWithError(w http.ResponseWriter, statusCode int, msg string) {
 	errorJson := map[string]string{"error": msg}
 